@@ -0,0 +1,41 @@
+package logwriter
+
+import (
+	"context"
+	"io"
+)
+
+type blockingHandle struct {
+	l *LogWriter
+}
+
+// BlockingHandle returns an io.Writer that writes to the same buffer as the LogWriter,
+// but whose Write blocks the calling goroutine until the record is buffered instead of skipping it.
+// Other writers, including other handles, are not blocked by a waiting handle, and Write of the LogWriter stays non-blocking.
+// Waiting handles are served in the order they started waiting.
+// A record that can never fit into the buffer is skipped with ErrRecordTooLarge.
+func (l *LogWriter) BlockingHandle() io.Writer {
+	return blockingHandle{l: l}
+}
+
+func (h blockingHandle) Write(p []byte) (n int, err error) {
+	return h.l.WriteContext(context.Background(), p)
+}
+
+// WriteContext appends the contents of p to the circular buffer, waiting for free space like the Write of BlockingHandle,
+// but gives up and returns ctx.Err() as soon as ctx is done. A cancelled record is not buffered; the Outs get it as with Write.
+// A record that can never fit into the buffer goes to OverflowWriter, if it is set.
+// This suits request handlers that want back pressure but must not block past their deadline.
+func (l *LogWriter) WriteContext(ctx context.Context, p []byte) (n int, err error) {
+	if len(p) < 1 {
+		return 0, nil
+	}
+	if l.oversize(len(p)) {
+		return 0, ErrRecordOversize
+	}
+
+	if err = l.storeContext(ctx, l.normalize(p), nil, true); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
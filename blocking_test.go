@@ -0,0 +1,144 @@
+package logwriter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlockingHandle(t *testing.T) {
+	var skipCount int
+	var tb testBuffer
+	tb.delay = 5 * time.Millisecond
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:  32,
+		FlashPeriod: 10 * time.Millisecond,
+		SkipHandler: func(n int) { skipCount += n }})
+	defer lg.Close()
+
+	var wg sync.WaitGroup
+	for h := 0; h < 3; h++ {
+		wg.Add(1)
+		go func(h int) {
+			defer wg.Done()
+			w := lg.BlockingHandle()
+			for i := 0; i < 20; i++ {
+				if _, err := w.Write([]byte(fmt.Sprintf("b%d%02d;", h, i))); err != nil {
+					t.Error("Expected nil error, got", err)
+				}
+			}
+		}(h)
+	}
+	for i := 0; i < 100; i++ {
+		lg.Write([]byte("n;"))
+	}
+	wg.Wait()
+	lg.Flush()
+
+	out := tb.buf.String()
+	for h := 0; h < 3; h++ {
+		for i := 0; i < 20; i++ {
+			if !strings.Contains(out, fmt.Sprintf("b%d%02d;", h, i)) {
+				t.Errorf("Expected record b%d%02d in output", h, i)
+			}
+		}
+	}
+	if n := strings.Count(out, "n;"); n+skipCount != 100 {
+		t.Errorf("Expected 100 non-blocking records written or skipped, got %d + %d", n, skipCount)
+	}
+
+	if _, err := lg.BlockingHandle().Write(make([]byte, 32)); err == nil {
+		t.Error("Expected error for a record larger than the buffer")
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	var tb testBuffer
+	tb.delay = 300 * time.Millisecond
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: 10 * time.Millisecond})
+	defer lg.Close()
+
+	lg.Write([]byte("test1test2"))
+	testSleep(20)
+
+	// the first waiter times out, the second one must still get its turn
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		testSleep(10)
+		_, err := lg.WriteContext(context.Background(), []byte("test3test4"))
+		done <- err
+	}()
+
+	start := time.Now()
+	if _, err := lg.WriteContext(ctx, []byte("test5test6")); err != context.DeadlineExceeded {
+		t.Error("Expected context.DeadlineExceeded, got", err)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Error("Expected prompt return on timeout, got", d)
+	}
+
+	if err := <-done; err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	// written in two chunks, wrapped around the buffer end
+	lg.Flush()
+	if tb.buf.String() != "test1test2test3test4" {
+		t.Error("Expected output = test1test2test3test4, got", tb.buf.String())
+	}
+}
+
+func TestWriteContextOutsAndSpill(t *testing.T) {
+	var tb1, tb2, spill testBuffer
+	lg := New(LogConfig{Out: &tb1, Outs: []io.Writer{&tb2}, OverflowWriter: &spill, ChannelCapacity: testChannelCapacity,
+		MaxBufSize: 16, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	if n, err := lg.WriteContext(context.Background(), []byte("test1")); n != 5 || err != nil {
+		t.Error("Expected 5, nil, got", n, err)
+	}
+	// larger than the buffer, so it goes to OverflowWriter
+	if n, err := lg.WriteContext(context.Background(), []byte("0123456789abcdefghij")); n != 20 || err != nil {
+		t.Error("Expected 20, nil, got", n, err)
+	}
+	lg.Flush()
+	if tb1.buf.String() != "test1" || tb2.buf.String() != "test1" {
+		t.Error("Expected output = test1 in Out and the Outs, got", tb1.buf.String(), tb2.buf.String())
+	}
+	if spill.buf.String() != "0123456789abcdefghij" || lg.Metrics().SpilledRecords != 1 {
+		t.Error("Expected the large record in OverflowWriter, got", spill.buf.String(), lg.Metrics().SpilledRecords)
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	var skipCount int
+	var tb testBuffer
+	tb.delay = 5 * time.Millisecond
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:     16,
+		FlashPeriod:    10 * time.Millisecond,
+		OverflowPolicy: OverflowBlock,
+		SkipHandler:    func(n int) { skipCount += n }})
+	defer lg.Close()
+
+	for i := 0; i < 50; i++ {
+		lg.Write([]byte("test1"))
+	}
+	if err := lg.WriteAndWait([]byte("test2")); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if tb.buf.Len() != 255 {
+		t.Error("Expected output length = 255, got", tb.buf.Len())
+	}
+
+	// a record larger than the buffer is skipped, but not as a full buffer
+	lg.Write(make([]byte, 16))
+	if m := lg.Metrics(); m.TooLargeRecords != 1 || m.SkippedRecords != 0 || skipCount != 0 {
+		t.Error("Expected one too large record and no skips, got", m, skipCount)
+	}
+}
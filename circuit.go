@@ -0,0 +1,31 @@
+package logwriter
+
+import "time"
+
+// circuit is a circuit breaker around Out. It is used only by ioHandler, so it needs no locking.
+// It is closed while failures < threshold, open until openUntil after that,
+// and half-open (one probe write allowed) once openUntil has passed.
+type circuit struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func (c *circuit) allow(now time.Time) bool {
+	if c.threshold <= 0 || c.failures < c.threshold {
+		return true
+	}
+	return !now.Before(c.openUntil)
+}
+
+func (c *circuit) success() {
+	c.failures = 0
+}
+
+func (c *circuit) failure(now time.Time) {
+	c.failures++
+	if c.threshold > 0 && c.failures >= c.threshold {
+		c.openUntil = now.Add(c.cooldown)
+	}
+}
@@ -0,0 +1,58 @@
+package logwriter
+
+import (
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/oleg-safonov/logwriter/logwritertest"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var errorCount int
+	var reasons []SkipReason
+
+	var tb testBuffer
+	out := logwritertest.NewLimitedWriter(&tb, 0)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := &fakeClock{now: start, tick: make(chan time.Time)}
+	lg := New(LogConfig{Out: out, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity,
+		CircuitThreshold:  2,
+		CircuitCooldown:   200 * time.Millisecond,
+		WriteErrorHandler: func(out io.Writer) { errorCount++ },
+		SkipReasonHandler: func(n int, reason SkipReason) { reasons = append(reasons, reason) },
+		clock:             clk})
+	defer lg.Close()
+
+	step := func(record string, calls int, errors int) {
+		t.Helper()
+		lg.WriteAndWait([]byte(record))
+		if tb.calls != calls || errorCount != errors {
+			t.Errorf("After %s expected successful calls = %d, errors = %d, got %d, %d", record, calls, errors, tb.calls, errorCount)
+		}
+	}
+
+	step("test1", 0, 1)
+	step("test2", 0, 2) // opened
+	step("test3", 0, 2)
+	if err := lg.WriteAndWait([]byte("test3a")); err != ErrCircuitOpen {
+		t.Error("Expected ErrCircuitOpen, got", err)
+	}
+	clk.set(start.Add(200 * time.Millisecond))
+	step("test4", 0, 3) // failed probe, opened again
+	out.N = 1 << 20
+	clk.set(start.Add(400 * time.Millisecond))
+	step("test5", 1, 3) // successful probe, closed
+	step("test6", 2, 3)
+
+	if tb.buf.String() != "test5test6" {
+		t.Error("Expected output = test5test6, got", tb.buf.String())
+	}
+	if m := lg.Metrics(); m.CircuitDroppedRecords != 2 || m.CircuitDroppedBytes != 11 || m.SkippedRecords != 0 {
+		t.Error("Expected 2 dropped records of 11 bytes, got", m)
+	}
+	if !slices.Equal(reasons, []SkipReason{DroppedCircuitOpen, DroppedCircuitOpen}) {
+		t.Error("Expected reasons = [DroppedCircuitOpen DroppedCircuitOpen], got", reasons)
+	}
+}
@@ -0,0 +1,88 @@
+package logwriter
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// clock is the source of time for scheduled work, replaced in tests.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) ticker
+}
+
+// ticker is the part of time.Ticker used by LogWriter.
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTicker) Stop() {
+	t.t.Stop()
+}
+
+// idleTicker is a ticker that never ticks.
+type idleTicker struct{}
+
+func (idleTicker) C() <-chan time.Time {
+	return nil
+}
+
+func (idleTicker) Stop() {}
+
+// jitterTicker is a ticker whose every interval is period changed by a random fraction of up to ±jitter, for FlushJitter.
+// Like time.Ticker, it drops the ticks a slow receiver is not ready for.
+type jitterTicker struct {
+	c    chan time.Time
+	stop chan struct{}
+}
+
+func newJitterTicker(clk clock, period time.Duration, jitter float64) jitterTicker {
+	t := jitterTicker{c: make(chan time.Time, 1), stop: make(chan struct{})}
+	go func() {
+		for {
+			d := time.Duration(float64(period) * (1 + jitter*(2*rand.Float64()-1)))
+			select {
+			case now := <-clk.After(max(d, minFlashPeriod)):
+				select {
+				case t.c <- now:
+				default:
+				}
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func (t jitterTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t jitterTicker) Stop() {
+	close(t.stop)
+}
@@ -0,0 +1,67 @@
+package logwriter
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a clock controlled by the test: After reports the duration to waiting and fires when the test sends to after,
+// tickers fire when the test sends to tick. Now returns now, which the test changes with set while LogWriter runs.
+// period is the period of the last ticker created.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	period  time.Duration
+	after   chan time.Time
+	waiting chan time.Duration
+	tick    chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) set(now time.Time) {
+	c.mu.Lock()
+	c.now = now
+	c.mu.Unlock()
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waiting <- d
+	return c.after
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	c.period = d
+	c.mu.Unlock()
+	return fakeTicker(c.tick)
+}
+
+func (c *fakeClock) tickerPeriod() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.period
+}
+
+type fakeTicker chan time.Time
+
+func (t fakeTicker) C() <-chan time.Time {
+	return t
+}
+
+func (t fakeTicker) Stop() {}
+
+// tickUntilWritten fires the ticker of lg until all buffered records are written; it reports false if they never are.
+func tickUntilWritten(lg *LogWriter, clk *fakeClock) bool {
+	for i := 0; i < 100; i++ {
+		if lg.Stats().UsedBytes == 0 {
+			return true
+		}
+		clk.tick <- clk.Now()
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package logwriter
+
+import "slices"
+
+// dropOldest makes room for a record of lenP bytes by discarding the oldest queued records.
+// Only records that ioHandler has not received yet are discarded, so a region it is writing is never reused;
+// the records queued after them are moved down to keep the buffer contiguous.
+// It returns the number of discarded records and, if SkipHandlerBytes is set, their copies;
+// if discarding can not make enough room, nothing is changed and it returns 0.
+// The records taken out of the channel are put back in front of the queued parts, for the caller to send.
+// It must be called under muInput.
+func (l *LogWriter) dropOldest(lenP int) (int, [][]byte) {
+	l.muInternal.Lock()
+	defer l.muInternal.Unlock()
+
+	var queued []part
+take:
+	for {
+		select {
+		case p := <-l.inputRecords:
+			queued = append(queued, p)
+		default:
+			break take
+		}
+	}
+
+	// the rest of a wrapped record whose first part ioHandler already has must stay in place
+	first := 0
+	if len(queued) > 0 && queued[0].tail {
+		first = 1
+	}
+
+	free := l.freeSize()
+	end := first
+	dropped := 0
+	for end < len(queued) && (free < lenP || len(queued)-(end-first) >= l.recordLimit()) {
+		n := 1
+		if queued[end].more {
+			n = 2
+		}
+		if end+n > len(queued) || !l.droppable(queued[end:end+n]) {
+			break
+		}
+		for _, p := range queued[end : end+n] {
+			free += p.ePos - p.sPos
+		}
+		end += n
+		dropped++
+	}
+
+	if dropped == 0 || free < lenP || len(queued)-(end-first) >= l.recordLimit() {
+		l.queued = append(queued, l.queued...)
+		return 0, nil
+	}
+
+	var lost [][]byte
+	if l.skipHandlerBytes != nil {
+		for _, p := range queued[first:end] {
+			b := (*p.pBuf)[p.sPos:p.ePos]
+			if p.tail {
+				lost[len(lost)-1] = append(lost[len(lost)-1], b...)
+			} else {
+				lost = append(lost, append([]byte(nil), b...))
+			}
+		}
+	}
+
+	// save the records queued after the dropped ones, as moving them may overwrite their old place
+	rest := queued[end:]
+	data := make([][]byte, len(rest))
+	for i, p := range rest {
+		if p.tail {
+			continue
+		}
+		data[i] = append([]byte(nil), (*p.pBuf)[p.sPos:p.ePos]...)
+		if p.more {
+			data[i] = append(data[i], (*rest[i+1].pBuf)[rest[i+1].sPos:rest[i+1].ePos]...)
+		}
+	}
+
+	requeued := slices.Clone(queued[:first])
+	l.endPos = queued[first].sPos
+	for i, p := range rest {
+		if p.tail {
+			continue
+		}
+		if len(data[i]) == 0 {
+			// a control part: it only marks a position
+			p.sPos, p.ePos = l.endPos, l.endPos
+			requeued = append(requeued, p)
+			continue
+		}
+		parts, n := l.reserve(len(data[i]))
+		last := p.meta
+		if p.more {
+			last = rest[i+1].meta
+		}
+		parts[n-1].meta = last
+		b := data[i]
+		for _, q := range parts[:n] {
+			q.out = p.out
+			b = b[copy((*q.pBuf)[q.sPos:q.ePos], b):]
+			requeued = append(requeued, q)
+		}
+	}
+	l.queued = append(requeued, l.queued...)
+	return dropped, lost
+}
+
+// droppable reports whether the parts form a plain record of the current buffer that may be discarded.
+func (l *LogWriter) droppable(parts []part) bool {
+	for _, p := range parts {
+		if p.pBuf != l.buf || p.input != nil || p.meta != nil || p.ePos == p.sPos {
+			return false
+		}
+	}
+	return true
+}
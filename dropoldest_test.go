@@ -0,0 +1,70 @@
+package logwriter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOverflowDropOldest(t *testing.T) {
+	var skipCount, dropCount int
+	var lost []string
+	var tb testBuffer
+	tb.delay = 100 * time.Millisecond
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:       16,
+		ChunkSize:        1,
+		OverflowPolicy:   OverflowDropOldest,
+		SkipHandler:      func(n int) { skipCount += n },
+		SkipHandlerBytes: func(record []byte) { lost = append(lost, string(record)) },
+		SkipReasonHandler: func(n int, reason SkipReason) {
+			if reason == DroppedOldest {
+				dropCount += n
+			}
+		}})
+	defer lg.Close()
+
+	lg.Write([]byte("test0"))
+	testSleep(20)
+	for i := 1; i < 5; i++ {
+		if _, err := lg.Write([]byte{'t', 'e', 's', 't', byte('0' + i)}); err != nil {
+			t.Error("Expected nil error, got", err)
+		}
+	}
+	lg.Close()
+
+	if tb.buf.String() != "test0test3test4" {
+		t.Error("Expected output = test0test3test4, got", tb.buf.String())
+	}
+	if skipCount != 2 || dropCount != 2 {
+		t.Error("Expected 2 dropped records, got", skipCount, dropCount)
+	}
+	if len(lost) != 2 || lost[0] != "test1" || lost[1] != "test2" {
+		t.Error("Expected lost records test1, test2, got", lost)
+	}
+
+	var reasons []SkipReason
+	tb = testBuffer{delay: 100 * time.Millisecond}
+	lg = New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:        16,
+		ChunkSize:         1,
+		OverflowPolicy:    OverflowDropOldest,
+		SkipReasonHandler: func(n int, reason SkipReason) { reasons = append(reasons, reason) }})
+	defer lg.Close()
+
+	lg.Write([]byte("0123456789"))
+	lg.Flush()
+	lg.Write([]byte("xxxx"))
+	testSleep(20)
+	lg.Write([]byte("abcd")) // wraps around the buffer end
+	lg.Write([]byte("ef"))
+	lg.Write([]byte("ghijklm"))
+	lg.Write(make([]byte, 16))
+	lg.Close()
+
+	if tb.buf.String() != "0123456789xxxxefghijklm" {
+		t.Error("Expected output = 0123456789xxxxefghijklm, got", tb.buf.String())
+	}
+	if len(reasons) != 2 || reasons[0] != DroppedOldest || reasons[1] != SkippedTooLarge {
+		t.Error("Expected reasons [DroppedOldest SkippedTooLarge], got", reasons)
+	}
+}
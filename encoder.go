@@ -0,0 +1,92 @@
+package logwriter
+
+import (
+	"bytes"
+	"time"
+	"unicode/utf8"
+)
+
+// Encoder serializes records before they are buffered, see LogConfig.Encoder.
+// Encode appends the encoded record to dst and returns the extended slice. It must not keep record after returning.
+type Encoder interface {
+	Encode(dst []byte, record []byte) []byte
+}
+
+// JSONEncoder is an Encoder that wraps each record in a JSON object with the time of the Write call and a level:
+//
+//	{"time":"2024-01-02T03:04:05.000000006Z","level":"info","msg":"the record"}
+//
+// The record becomes the "msg" string; a trailing line ending is kept after the object instead of being escaped,
+// so records of a log.Logger give one JSON object per line.
+type JSONEncoder struct {
+	Level      string // the "level" field, omitted if empty
+	TimeFormat string // the layout of the "time" field, time.RFC3339Nano if empty
+
+	now func() time.Time // time.Now if nil; set by tests
+}
+
+// Encode implements Encoder.
+func (e JSONEncoder) Encode(dst []byte, record []byte) []byte {
+	now := time.Now
+	if e.now != nil {
+		now = e.now
+	}
+	format := e.TimeFormat
+	if format == "" {
+		format = time.RFC3339Nano
+	}
+
+	msg := bytes.TrimSuffix(record, []byte("\n"))
+	if len(msg) < len(record) {
+		msg = bytes.TrimSuffix(msg, []byte("\r"))
+	}
+
+	dst = append(dst, `{"time":"`...)
+	dst = now().AppendFormat(dst, format)
+	dst = append(dst, '"')
+	if e.Level != "" {
+		dst = append(dst, `,"level":`...)
+		dst = appendJSONString(dst, []byte(e.Level))
+	}
+	dst = append(dst, `,"msg":`...)
+	dst = appendJSONString(dst, msg)
+	dst = append(dst, '}')
+	return append(dst, record[len(msg):]...)
+}
+
+// appendJSONString appends s as a quoted JSON string. Invalid UTF-8 is replaced with U+FFFD.
+func appendJSONString[S string | []byte](dst []byte, s S) []byte {
+	const hex = "0123456789abcdef"
+
+	dst = append(dst, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= utf8.RuneSelf {
+			// a short conversion that does not escape is not allocated
+			r, size := utf8.DecodeRuneInString(string(s[i:min(i+utf8.UTFMax, len(s))]))
+			if r == utf8.RuneError && size == 1 {
+				dst = append(dst, `�`...)
+			} else {
+				dst = append(dst, s[i:i+size]...)
+			}
+			i += size
+			continue
+		}
+		switch {
+		case c == '"' || c == '\\':
+			dst = append(dst, '\\', c)
+		case c == '\n':
+			dst = append(dst, '\\', 'n')
+		case c == '\r':
+			dst = append(dst, '\\', 'r')
+		case c == '\t':
+			dst = append(dst, '\\', 't')
+		case c < 0x20:
+			dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			dst = append(dst, c)
+		}
+		i++
+	}
+	return append(dst, '"')
+}
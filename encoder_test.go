@@ -0,0 +1,54 @@
+package logwriter
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONEncoder(t *testing.T) {
+	enc := JSONEncoder{Level: "info", now: func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC) }}
+
+	tests := []struct {
+		record, msg, ending string
+	}{
+		{"test1", "test1", ""},
+		{"test2\n", "test2", "\n"},
+		{"test3\r\n", "test3", "\r\n"},
+		{"a \"quoted\" \\ line\twith\x01control\nand more", "a \"quoted\" \\ line\twith\x01control\nand more", ""},
+		{"invalid \xff utf-8, ünïcode", "invalid � utf-8, ünïcode", ""},
+	}
+
+	for _, tt := range tests {
+		b := enc.Encode(nil, []byte(tt.record))
+		obj := strings.TrimRight(string(b), "\r\n")
+		ending := string(b)[len(obj):]
+		var v struct{ Time, Level, Msg string }
+		if err := json.Unmarshal([]byte(obj), &v); err != nil {
+			t.Errorf("Expected valid JSON for %q, got %s: %v", tt.record, b, err)
+			continue
+		}
+		if v.Time != "2024-01-02T03:04:05.000000006Z" || v.Level != "info" || v.Msg != tt.msg || ending != tt.ending {
+			t.Errorf("Expected %q with ending %q, got %s", tt.msg, tt.ending, b)
+		}
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var tb testBuffer
+	enc := JSONEncoder{now: func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }, TimeFormat: time.DateOnly}
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 64, FlashPeriod: time.Hour, Encoder: enc, LineEnding: LineEndingLF})
+	defer lg.Close()
+
+	lg.Write([]byte("test1\r\n"))
+	// the encoded record is too large for the buffer
+	if _, err := lg.Write([]byte(strings.Repeat("a", 40))); err != ErrRecordTooLarge {
+		t.Error("Expected ErrRecordTooLarge, got", err)
+	}
+	lg.Flush()
+
+	if expected := "{\"time\":\"2024-01-02\",\"msg\":\"test1\"}\n"; tb.buf.String() != expected {
+		t.Errorf("Expected output = %q, got %q", expected, tb.buf.String())
+	}
+}
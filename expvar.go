@@ -0,0 +1,53 @@
+package logwriter
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+)
+
+// muExpvar guards expvars and the choice of unique expvar prefixes.
+var muExpvar sync.Mutex
+
+// expvars is the expvar map "logwriter" with the counters of the open LogWriters that have ExpvarPrefix set, by prefix.
+// It is published with the first of them.
+var expvars *expvar.Map
+
+// publishExpvar publishes the counters of l in expvars under prefix, as an object with records, skipped,
+// write_errors and buffer_used. If the prefix is taken by another LogWriter, "_2", "_3" and so on
+// is appended to it. It returns the prefix used.
+func (l *LogWriter) publishExpvar(prefix string) string {
+	muExpvar.Lock()
+	defer muExpvar.Unlock()
+
+	if expvars == nil {
+		expvars = expvar.NewMap("logwriter")
+	}
+	unique := prefix
+	for i := 2; expvars.Get(unique) != nil; i++ {
+		unique = prefix + "_" + strconv.Itoa(i)
+	}
+
+	expvars.Set(unique, expvar.Func(func() any {
+		return map[string]any{
+			"records":      l.metrics.totalRecords.Load(),
+			"skipped":      l.metrics.skippedRecords.Load(),
+			"write_errors": l.metrics.writeErrors.Load(),
+			"buffer_used":  l.Len(),
+		}
+	}))
+	l.expvarPrefix = unique
+	return unique
+}
+
+// unpublishExpvar removes the counters of l from expvars, so they no longer keep l from being garbage collected
+// and the prefix can be used again.
+func (l *LogWriter) unpublishExpvar() {
+	muExpvar.Lock()
+	defer muExpvar.Unlock()
+
+	if l.expvarPrefix != "" {
+		expvars.Delete(l.expvarPrefix)
+		l.expvarPrefix = ""
+	}
+}
@@ -0,0 +1,52 @@
+package logwriter
+
+import (
+	"expvar"
+	"testing"
+)
+
+// expvarCounter returns the counter name published under prefix, or nil if there is none.
+func expvarCounter(prefix, name string) any {
+	m, _ := expvar.Get("logwriter").(*expvar.Map)
+	if m == nil {
+		return nil
+	}
+	v, _ := m.Get(prefix).(expvar.Func)
+	if v == nil {
+		return nil
+	}
+	return v().(map[string]any)[name]
+}
+
+func TestExpvar(t *testing.T) {
+	var tb testBuffer
+	var warnings []string
+	lg1 := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, ExpvarPrefix: "testlog"})
+	defer lg1.Close()
+	lg2 := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, ExpvarPrefix: "testlog", InternalLogger: func(msg string) { warnings = append(warnings, msg) }})
+	defer lg2.Close()
+
+	lg1.WriteAndWait([]byte("test1"))
+	if v := expvarCounter("testlog", "records"); v != uint64(1) {
+		t.Error("Expected testlog records = 1, got", v)
+	}
+	if v := expvarCounter("testlog", "buffer_used"); v != 0 {
+		t.Error("Expected testlog buffer_used = 0, got", v)
+	}
+	if v := expvarCounter("testlog_2", "records"); v != uint64(0) {
+		t.Error("Expected testlog_2 records = 0, got", v)
+	}
+	if len(warnings) != 1 {
+		t.Error("Expected a warning about the taken prefix, got", warnings)
+	}
+
+	lg1.Close()
+	if v := expvarCounter("testlog", "records"); v != nil {
+		t.Error("Expected testlog to be removed on Close, got", v)
+	}
+	lg3 := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, ExpvarPrefix: "testlog"})
+	defer lg3.Close()
+	if v := expvarCounter("testlog", "records"); v != uint64(0) {
+		t.Error("Expected the prefix of a closed LogWriter to be free, got", v)
+	}
+}
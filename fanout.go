@@ -0,0 +1,83 @@
+package logwriter
+
+import (
+	"io"
+	"strconv"
+)
+
+// newSinks creates a LogWriter for each of config.Outs, with the same settings as the primary one.
+// Sink i reports to the sink handlers with index i+1; the primary LogWriter has index 0.
+func newSinks(config LogConfig) []*LogWriter {
+	if len(config.Outs) == 0 {
+		return nil
+	}
+
+	sinks := make([]*LogWriter, len(config.Outs))
+	for i, out := range config.Outs {
+		c := config
+		c.Out = out
+		c.Outs = nil
+		c.SkipHandler = skipHandlerFor(config, i+1)
+		c.WriteErrorHandler = writeErrorHandlerFor(config, i+1)
+		c.SinkSkipHandler = nil
+		c.SinkWriteErrorHandler = nil
+		if config.Name != "" {
+			c.Name = config.Name + "/" + strconv.Itoa(i+1)
+		}
+		// the state and the spill of the primary buffer only
+		c.OnBackpressure = nil
+		c.OverflowWriter = nil
+		// a signal is received by one goroutine only
+		c.FlushSignal = nil
+		// rotation and expvar belong to the primary Out
+		c.RotateAt = nil
+		c.RotateHandler = nil
+		c.ExpvarPrefix = ""
+		sinks[i] = New(c)
+	}
+	return sinks
+}
+
+// skipHandlerFor returns SkipHandler of config, also calling SinkSkipHandler with the index of the sink.
+func skipHandlerFor(config LogConfig, sink int) func(int) {
+	if config.SinkSkipHandler == nil {
+		return config.SkipHandler
+	}
+	return func(n int) {
+		if config.SkipHandler != nil {
+			config.SkipHandler(n)
+		}
+		config.SinkSkipHandler(sink, n)
+	}
+}
+
+// writeErrorHandlerFor returns WriteErrorHandler of config, also calling SinkWriteErrorHandler with the index of the sink.
+func writeErrorHandlerFor(config LogConfig, sink int) func(io.Writer) {
+	if config.SinkWriteErrorHandler == nil {
+		return config.WriteErrorHandler
+	}
+	return func(out io.Writer) {
+		if config.WriteErrorHandler != nil {
+			config.WriteErrorHandler(out)
+		}
+		config.SinkWriteErrorHandler(sink, out)
+	}
+}
+
+// Sinks returns the LogWriters of LogConfig.Outs, in the same order, for example to read their Stats or Metrics.
+// Records written to l are copied to each of them; Reset, SwapOutput and Tail apply to the primary Out only.
+func (l *LogWriter) Sinks() []*LogWriter {
+	return l.sinks
+}
+
+// fanOut copies a record to the sinks. Their results do not affect the result for the primary Out.
+// If try is set, a sink whose buffer is busy skips the record, as with TryWrite.
+func (l *LogWriter) fanOut(rec record, try bool) {
+	for _, s := range l.sinks {
+		if try {
+			s.buffer(rec, nil, true)
+		} else {
+			s.store(rec, nil)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package logwriter
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestOuts(t *testing.T) {
+	var tb0, tb1, tb2 testBuffer
+	tb1.delay = 300 * time.Millisecond
+	skips := make(map[int]int)
+	var skipCount int
+	lg := New(LogConfig{Out: &tb0, ChannelCapacity: testChannelCapacity,
+		Outs:            []io.Writer{&tb1, &tb2},
+		MaxBufSize:      16,
+		FlashPeriod:     10 * time.Millisecond,
+		SkipHandler:     func(n int) { skipCount += n },
+		SinkSkipHandler: func(sink int, n int) { skips[sink] += n }})
+	defer lg.Close()
+
+	if len(lg.Sinks()) != 2 {
+		t.Error("Expected 2 sinks, got", len(lg.Sinks()))
+	}
+
+	lg.Write([]byte("test1"))
+	// Outs[0] is still writing test1 when the next records come, the others are done with it
+	for i := 0; i < 100 && (lg.Len() > 0 || lg.Sinks()[1].Len() > 0); i++ {
+		testSleep(1)
+	}
+	for i := 0; i < 3; i++ {
+		lg.Write([]byte("test2"))
+	}
+	lg.Close()
+
+	if tb0.buf.String() != "test1test2test2test2" || tb2.buf.String() != tb0.buf.String() {
+		t.Error("Expected all records in Out and Outs[1], got", tb0.buf.String(), tb2.buf.String())
+	}
+	if skips[0] != 0 || skips[2] != 0 || skips[1] != 1 || skipCount != skips[1] {
+		t.Error("Expected skips in Outs[0] only, got", skips, skipCount)
+	}
+}
@@ -0,0 +1,129 @@
+package logwriter
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxPooledRecord is the capacity above which the buffer of a RecordBuilder is not kept for reuse,
+// so one huge record does not pin its memory in the pool.
+const maxPooledRecord = 64 << 10
+
+var recordPool = sync.Pool{New: func() any { return &RecordBuilder{buf: make([]byte, 0, 256)} }}
+
+// RecordBuilder builds a record of key/value fields, written to the LogWriter as a JSON object on a line of its own:
+//
+//	{"msg":"hello","code":42}
+//
+// Get one with Record, add the fields and call Commit or Discard exactly once; the RecordBuilder must not be used after that.
+// The fields are appended to a pooled buffer reused by later records, so building a record does not allocate,
+// and Commit copies it into the circular buffer once, like Write, but without Encoder and TimestampFormat. The record is not built in the circular buffer itself:
+// that would hold the buffer lock while the fields are added, stopping every other writer, and a record that is
+// never committed would stop the LogWriter for good. A RecordBuilder is not safe for concurrent use.
+type RecordBuilder struct {
+	l   *LogWriter
+	buf []byte
+}
+
+// Record returns a RecordBuilder for a new record of l.
+func (l *LogWriter) Record() *RecordBuilder {
+	r := recordPool.Get().(*RecordBuilder)
+	r.l = l
+	r.buf = append(r.buf[:0], '{')
+	return r
+}
+
+// key appends the separator and the key of the next field.
+func (r *RecordBuilder) key(k string) {
+	if len(r.buf) > 1 {
+		r.buf = append(r.buf, ',')
+	}
+	r.buf = appendJSONString(r.buf, k)
+	r.buf = append(r.buf, ':')
+}
+
+// Str adds a string field.
+func (r *RecordBuilder) Str(key, val string) *RecordBuilder {
+	r.key(key)
+	r.buf = appendJSONString(r.buf, val)
+	return r
+}
+
+// Bytes adds a string field with the text in val.
+func (r *RecordBuilder) Bytes(key string, val []byte) *RecordBuilder {
+	r.key(key)
+	r.buf = appendJSONString(r.buf, val)
+	return r
+}
+
+// Int adds an integer field.
+func (r *RecordBuilder) Int(key string, val int64) *RecordBuilder {
+	r.key(key)
+	r.buf = strconv.AppendInt(r.buf, val, 10)
+	return r
+}
+
+// Float adds a number field. NaN and the infinities, which JSON has no numbers for, are added as strings.
+func (r *RecordBuilder) Float(key string, val float64) *RecordBuilder {
+	r.key(key)
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		r.buf = append(r.buf, '"')
+		r.buf = strconv.AppendFloat(r.buf, val, 'g', -1, 64)
+		r.buf = append(r.buf, '"')
+		return r
+	}
+	r.buf = strconv.AppendFloat(r.buf, val, 'g', -1, 64)
+	return r
+}
+
+// Bool adds a boolean field.
+func (r *RecordBuilder) Bool(key string, val bool) *RecordBuilder {
+	r.key(key)
+	r.buf = strconv.AppendBool(r.buf, val)
+	return r
+}
+
+// Time adds a time field in the RFC 3339 format with nanoseconds.
+func (r *RecordBuilder) Time(key string, val time.Time) *RecordBuilder {
+	r.key(key)
+	r.buf = append(r.buf, '"')
+	r.buf = val.AppendFormat(r.buf, time.RFC3339Nano)
+	r.buf = append(r.buf, '"')
+	return r
+}
+
+// Commit writes the record to the LogWriter as Write does and returns the error of Write.
+// The record takes space in the buffer only now, so under backpressure it is skipped like any other record,
+// and a record that does not fit into the buffer at all returns ErrRecordTooLarge without taking space.
+// The record is JSON already, so Encoder and TimestampFormat, which would break it, do not apply to it;
+// LineEnding, RecordPrefix and RecordSuffix do.
+func (r *RecordBuilder) Commit() error {
+	l := r.l
+	r.buf = append(r.buf, '}')
+	ending := lineEndings[LineEndingLF]
+	if l.lineEnding != LineEndingKeep {
+		ending = lineEndings[l.lineEnding]
+	}
+	var err error
+	if l.oversize(len(r.buf) + len(ending)) {
+		err = ErrRecordOversize
+	} else {
+		_, err = l.result(len(r.buf)+len(ending), l.store(record{l.recordPrefix, nil, r.buf, ending, l.recordSuffix}, nil))
+	}
+	r.release()
+	return err
+}
+
+// Discard drops the record without writing it.
+func (r *RecordBuilder) Discard() {
+	r.release()
+}
+
+func (r *RecordBuilder) release() {
+	r.l = nil
+	if cap(r.buf) <= maxPooledRecord {
+		recordPool.Put(r)
+	}
+}
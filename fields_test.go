@@ -0,0 +1,62 @@
+package logwriter
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRecordBuilder(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 128})
+	defer lg.Close()
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	err := lg.Record().Str("msg", "hello \"world\"\n").Int("code", 42).Float("ratio", 0.5).Float("nan", math.NaN()).
+		Bool("ok", true).Time("at", at).Bytes("raw", []byte("caf\xc3\xa9\xff")).Commit()
+	if err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	lg.Record().Str("msg", "dropped").Discard()
+	// the record can never fit into the buffer
+	if err := lg.Record().Bytes("big", make([]byte, 200)).Commit(); err != ErrRecordTooLarge {
+		t.Error("Expected ErrRecordTooLarge, got", err)
+	}
+	lg.Close()
+
+	expected := `{"msg":"hello \"world\"\n","code":42,"ratio":0.5,"nan":"NaN","ok":true,"at":"2024-01-02T03:04:05.000000006Z","raw":"café` + "�" + `"}` + "\n"
+	if tb.buf.String() != expected {
+		t.Errorf("Expected output = %q, got %q", expected, tb.buf.String())
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(tb.buf.Bytes(), &fields); err != nil || fields["code"] != 42.0 {
+		t.Error("Expected a valid JSON object, got", fields, err)
+	}
+}
+
+func BenchmarkRecordBuilder(b *testing.B) {
+	lg := New(LogConfig{Out: &testBuffer{}, MaxBufSize: 100 * b.N, MaxRecordsInBuf: b.N + 1, FlashPeriod: time.Hour})
+	defer lg.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lg.Record().Str("msg", "hello").Int("code", int64(i)).Commit()
+	}
+}
+
+func TestRecordBuilderEncoder(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity,
+		Encoder: JSONEncoder{}, TimestampFormat: time.RFC3339, LineEnding: LineEndingCRLF})
+	defer lg.Close()
+
+	// the record is JSON already: it is not wrapped by the Encoder nor prefixed with a timestamp
+	lg.Record().Str("msg", "hello").Commit()
+	lg.Close()
+
+	expected := `{"msg":"hello"}` + "\r\n"
+	if tb.buf.String() != expected {
+		t.Errorf("Expected output = %q, got %q", expected, tb.buf.String())
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/oleg-safonov/logwriter
+
+go 1.22
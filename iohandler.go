@@ -0,0 +1,526 @@
+package logwriter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ioState is the state of ioHandler, the background goroutine that writes the buffer to Out.
+// Only that goroutine uses it, so it needs no locking.
+type ioState struct {
+	l      *LogWriter
+	cBuf   *[]byte
+	out    io.Writer
+	input  chan part
+	period time.Duration
+
+	// (*cBuf)[s:e] is received and not written yet
+	s, e int
+	// partial is set while (*cBuf)[s:e] ends with the first part of a wrapped record
+	partial bool
+	// err is the first write error of the current record, reported to its done channel
+	err error
+	// mirror, while set, receives a copy of everything written to out, until mirrorUntil (MigrateTo)
+	mirror      io.Writer
+	mirrorUntil time.Time
+	// written counts the bytes written to out since it was set, for RotateBytes and ResetAndFlush
+	written int64
+	// retiredBytes counts the bytes written to the Outs replaced by Reset until the next drained part (ResetAndFlush)
+	retiredBytes int64
+	// unsynced counts the bytes written to out since lastSync, for SyncInterval and SyncBytes
+	unsynced int64
+	lastSync time.Time
+	// unwritten counts the records whose ends have been handed to emit or flush since the last write to out,
+	// which are lost if the circuit breaker discards that write
+	unwritten int
+	// passThrough is set if the writes to out are not held back or staged, so the parts of a wrapped record can go to sendParts
+	passThrough bool
+	// staged collects the writes to out up to OutBufferSize bytes, until drain sends them in one write
+	staged []byte
+	// held is the trailing partial line kept back by LineBuffered, since heldSince
+	held      []byte
+	heldSince time.Time
+	// chunkSize is ChunkSize, limited to the size of the current buffer
+	chunkSize int
+	// pending counts the records that end in (*cBuf)[s:e], for FlushRecordCount
+	pending int
+
+	ticker ticker
+	// nextRotate is the time of the next RotateInterval rotation, zero if there is none
+	nextRotate time.Time
+	// flushSignal is FlushSignal, nil once it is closed
+	flushSignal <-chan struct{}
+	// idle is set while AdaptiveFlush keeps the ticker stopped
+	idle bool
+}
+
+func (l *LogWriter) ioHandler(cBuf *[]byte, out io.Writer, input chan part, period time.Duration) {
+	h := &ioState{
+		l:           l,
+		cBuf:        cBuf,
+		out:         out,
+		input:       input,
+		period:      period,
+		lastSync:    l.clock.Now(),
+		passThrough: !l.lineBuffered && l.outBufferSize <= 0,
+		chunkSize:   l.chunkSize,
+		ticker:      idleTicker{},
+		flushSignal: l.flushSignal,
+	}
+	if !l.immediateFlush || l.lineBuffered || (l.rotateInterval > 0 && l.rotateHandler != nil) || l.syncInterval > 0 {
+		// with ImmediateFlush there is nothing left to write on a tick, unless time itself matters
+		h.ticker = l.newTicker(period)
+	}
+	defer func() { h.ticker.Stop() }()
+	if l.rotateInterval > 0 && l.rotateHandler != nil {
+		h.nextRotate = nextInterval(l.clock.Now(), l.rotateInterval, l.rotateAligned)
+	}
+
+	l.writeHeader(out)
+	for {
+		if l.adaptiveFlush {
+			h.adapt()
+		}
+		select {
+		case _, ok := <-h.flushSignal:
+			if !ok {
+				// a closed channel is always ready and would starve the other cases
+				h.flushSignal = nil
+				continue
+			}
+			h.signal()
+		case now := <-h.ticker.C():
+			h.tick(now)
+		case p := <-h.input:
+			if h.receive(p) {
+				close(l.done)
+				return
+			}
+		}
+	}
+}
+
+// sync commits the data written to out so far, before out is replaced too.
+func (h *ioState) sync() {
+	if h.unsynced > 0 {
+		h.l.syncOut(h.out)
+	}
+	h.unsynced = 0
+	h.lastSync = h.l.clock.Now()
+}
+
+// sendParts writes a and then b to out (and mirror) with one write, see writeParts.
+func (h *ioState) sendParts(a, b []byte) error {
+	l := h.l
+	err := l.writeParts(a, b, h.out)
+	if err != nil && err != ErrCircuitOpen && err != ErrCloseTimeout && l.reopenHandler != nil {
+		if w, rerr := l.reopenHandler(h.out); rerr != nil {
+			l.warn(fmt.Sprintf("logwriter: can not reopen Out: %v", rerr))
+		} else if w != nil {
+			h.out = w
+			h.written = 0
+			l.writeHeader(h.out)
+			err = l.writeParts(a, b, h.out)
+		}
+	}
+	if h.mirror != nil {
+		l.writeParts(a, b, h.mirror)
+	}
+	if err == ErrCircuitOpen {
+		l.circuitDropped(h.unwritten, len(a)+len(b))
+	}
+	h.unwritten = 0
+	if err == nil {
+		h.written += int64(len(a) + len(b))
+		if l.syncInterval > 0 || l.syncBytes > 0 {
+			h.unsynced += int64(len(a) + len(b))
+		}
+		if l.syncBytes > 0 && h.unsynced >= l.syncBytes {
+			h.sync()
+		}
+		// b ends in the middle of a wrapped record while partial is set, rotate after its rest
+		if l.rotateBytes > 0 && l.rotateHandler != nil && h.written >= l.rotateBytes && !h.partial {
+			h.written = 0
+			h.sync()
+			h.out = l.rotate(h.cBuf, h.out)
+		}
+	}
+	return err
+}
+
+// send writes b to out (and mirror).
+func (h *ioState) send(b []byte) error {
+	return h.sendParts(b, nil)
+}
+
+// vectorWrapped reports whether the parts of a wrapped record go to out in one vectored write.
+func (h *ioState) vectorWrapped() bool {
+	return h.passThrough && vectored(h.out) && (h.mirror == nil || vectored(h.mirror))
+}
+
+// drain writes the staged data.
+func (h *ioState) drain() error {
+	if len(h.staged) == 0 {
+		return nil
+	}
+	err := h.send(h.staged)
+	h.staged = h.staged[:0]
+	return err
+}
+
+// flush writes b to out, through staged if OutBufferSize is set.
+func (h *ioState) flush(b []byte) error {
+	size := h.l.outBufferSize
+	if size <= 0 {
+		return h.send(b)
+	}
+	var err error
+	if len(h.staged)+len(b) > size {
+		err = h.drain()
+	}
+	if len(b) >= size {
+		if werr := h.send(b); err == nil {
+			err = werr
+		}
+		return err
+	}
+	h.staged = append(h.staged, b...)
+	return err
+}
+
+// emit writes b after the held bytes; with LineBuffered it keeps back a trailing partial line for up to MaxLineDelay.
+func (h *ioState) emit(b []byte) error {
+	l := h.l
+	if !l.lineBuffered {
+		return h.flush(b)
+	}
+	wasHeld := len(h.held) > 0
+	if wasHeld {
+		b = append(h.held, b...)
+	}
+	var tail []byte
+	if i := bytes.LastIndexByte(b, '\n'); i+1 < len(b) {
+		now := l.clock.Now()
+		if i >= 0 || !wasHeld {
+			h.heldSince = now
+		}
+		if now.Sub(h.heldSince) < l.maxLineDelay {
+			b, tail = b[:i+1], b[i+1:]
+		}
+	}
+	var err error
+	if len(b) > 0 {
+		err = h.flush(b)
+	}
+	h.held = append(h.held[:0], tail...)
+	return err
+}
+
+// releaseHeld writes the held partial line, before switching Out or answering Flush.
+func (h *ioState) releaseHeld() error {
+	if len(h.held) == 0 {
+		return nil
+	}
+	err := h.flush(h.held)
+	h.held = h.held[:0]
+	return err
+}
+
+// cutOver ends the migration window.
+func (h *ioState) cutOver() {
+	if h.mirror != nil && !h.l.clock.Now().Before(h.mirrorUntil) {
+		h.drain()
+		h.sync()
+		h.out = h.mirror
+		h.mirror = nil
+	}
+}
+
+// free releases the written data at the start of the current buffer; everything pending is written by then.
+func (h *ioState) free(n int) {
+	h.l.freeMem(h.cBuf, n)
+	h.pending = 0
+}
+
+// writeOut flushes (*cBuf)[s:e] and frees it.
+func (h *ioState) writeOut() error {
+	if h.s >= h.e {
+		return nil
+	}
+	err := h.flush((*h.cBuf)[h.s:h.e])
+	h.free(h.e - h.s)
+	h.s = h.e
+	return err
+}
+
+// adapt stops the ticker when nothing waits for it and starts it again with the first record, for AdaptiveFlush.
+func (h *ioState) adapt() {
+	// RotateInterval and a MigrateTo window need the ticker even with nothing buffered
+	busy := h.s < h.e || len(h.held) > 0 || len(h.staged) > 0 || !h.nextRotate.IsZero() || h.mirror != nil ||
+		(h.l.syncInterval > 0 && h.unsynced > 0)
+	if busy && h.idle {
+		h.ticker = h.l.newTicker(h.period)
+		h.idle = false
+	} else if !busy && !h.idle {
+		h.ticker.Stop()
+		h.ticker = idleTicker{}
+		h.idle = true
+	}
+}
+
+// signal writes the buffer on a receive from FlushSignal.
+func (h *ioState) signal() {
+	h.releaseHeld()
+	if h.s < h.e && !(h.l.boundaryFlushOnly && h.partial) {
+		if werr := h.writeOut(); h.partial && h.err == nil {
+			h.err = werr
+		}
+	}
+	h.drain()
+}
+
+// tick writes the buffer every FlashPeriod and rotates Out every RotateInterval.
+func (h *ioState) tick(now time.Time) {
+	l := h.l
+	h.cutOver()
+	if !h.nextRotate.IsZero() && !h.partial && !now.Before(h.nextRotate) {
+		// the old Out gets everything buffered so far
+		h.releaseHeld()
+		h.writeOut()
+		h.drain()
+		h.sync()
+		h.out = l.rotate(h.cBuf, h.out)
+		h.written = 0
+		h.nextRotate = nextInterval(now, l.rotateInterval, l.rotateAligned)
+	}
+	syncDue := l.syncInterval > 0 && now.Sub(h.lastSync) >= l.syncInterval
+	if l.deferFlushWhileBusy && len(h.input) > 0 {
+		// more records are coming, let them coalesce; what Out has got so far is synced all the same
+		if syncDue {
+			h.drain()
+			h.sync()
+		}
+		return
+	}
+	if h.s < h.e && !(l.boundaryFlushOnly && h.partial) {
+		if werr := h.emit((*h.cBuf)[h.s:h.e]); h.partial && h.err == nil {
+			h.err = werr
+		}
+		h.free(h.e - h.s)
+		h.s = h.e
+	} else if len(h.held) > 0 {
+		// write the partial line once MaxLineDelay is over
+		h.emit(nil)
+	}
+	h.drain()
+	if syncDue {
+		h.sync()
+	}
+}
+
+// receive handles a part of the input channel: the control parts its meta carries first, then its data.
+// It reports whether the part stops ioHandler (Close).
+func (h *ioState) receive(p part) bool {
+	l := h.l
+	if p.input != nil {
+		h.input = p.input
+		return false
+	}
+
+	if !h.partial {
+		h.err = nil
+	}
+	h.cutOver()
+
+	if p.pBuf != h.cBuf {
+		h.switchBuffer(p)
+	}
+	if p.meta != nil && p.meta.drained != nil {
+		// the old buffers have been written
+		p.meta.flushed = int(h.retiredBytes)
+		h.retiredBytes = 0
+		close(p.meta.drained)
+	}
+	if p.meta != nil && p.meta.out != nil {
+		h.switchOut(p)
+	}
+	if p.meta != nil && p.meta.direct != nil {
+		// a record larger than the buffer, after the records before it
+		h.releaseHeld()
+		h.writeOut()
+		h.unwritten++
+		h.err = h.flush(p.meta.direct)
+	}
+
+	h.record(p)
+
+	if p.meta != nil && p.meta.done != nil && h.answer(p.meta) {
+		return true
+	}
+
+	if l.flushOnIdle && h.s < h.e && !h.partial && len(h.input) == 0 {
+		// the burst is over, do not wait for the ticker
+		h.emit((*h.cBuf)[h.s:h.e])
+		h.free(h.e - h.s)
+		h.s = h.e
+		h.drain()
+	}
+	return false
+}
+
+// switchBuffer moves to the buffer of p after writing the old one: after Reset, ResetConfig, SetMaxBufSize or growth.
+func (h *ioState) switchBuffer(p part) {
+	l := h.l
+	h.releaseHeld()
+	if h.s < h.e {
+		h.flush((*h.cBuf)[h.s:h.e])
+	}
+	h.drain()
+	h.cBuf = p.pBuf
+	h.chunkSize = min(l.chunkSize, len(*h.cBuf))
+	h.pending = 0
+	h.s = p.sPos
+	h.e = p.sPos
+	if p.meta == nil || !p.meta.grown {
+		h.retiredBytes += h.written
+		h.sync()
+		h.out = p.out
+		h.written = 0
+		h.mirror = nil
+		l.writeHeader(h.out)
+	}
+	if p.meta != nil && p.meta.period > 0 && p.meta.period != h.period {
+		// ResetConfig: period is the FlashPeriod of the ticker
+		h.period = p.meta.period
+		if _, stopped := h.ticker.(idleTicker); !stopped {
+			h.ticker.Stop()
+			h.ticker = l.newTicker(h.period)
+		}
+	}
+}
+
+// switchOut moves to the Out of SwapOutput, or starts the MigrateTo window; the data before the switch goes to the old Out only.
+func (h *ioState) switchOut(p part) {
+	l := h.l
+	h.releaseHeld()
+	if h.s < h.e {
+		h.err = h.flush((*h.cBuf)[h.s:h.e])
+		h.free(h.e - h.s)
+	}
+	if werr := h.drain(); h.err == nil {
+		h.err = werr
+	}
+	h.s = p.sPos
+	h.e = p.sPos
+	if p.meta.window > 0 {
+		h.mirror = p.meta.out
+		h.mirrorUntil = l.clock.Now().Add(p.meta.window)
+	} else {
+		h.sync()
+		h.out = p.meta.out
+		h.written = 0
+		h.mirror = nil
+	}
+	l.writeHeader(p.meta.out)
+}
+
+// record adds the data of p to (*cBuf)[s:e], writing what is there first if p does not follow it,
+// and writes (*cBuf)[s:e] once it makes up a chunk.
+func (h *ioState) record(p part) {
+	l := h.l
+	if h.e != p.sPos {
+		if l.boundaryFlushOnly && h.partial && h.passThrough {
+			// the tail and the head of the wrapped record in one write, without a copy if Out is vectored
+			if werr := h.sendParts((*h.cBuf)[h.s:h.e], (*h.cBuf)[p.sPos:p.ePos]); h.err == nil {
+				h.err = werr
+			}
+			h.free(h.e - h.s + p.ePos - p.sPos)
+			h.s = p.ePos
+			h.e = p.ePos
+		} else if l.boundaryFlushOnly && h.partial {
+			// join the tail and the head of the wrapped record into one write
+			chunk := make([]byte, 0, h.e-h.s+p.ePos-p.sPos)
+			chunk = append(chunk, (*h.cBuf)[h.s:h.e]...)
+			chunk = append(chunk, (*h.cBuf)[p.sPos:p.ePos]...)
+			if werr := h.emit(chunk); h.err == nil {
+				h.err = werr
+			}
+			h.free(len(chunk))
+			h.s = p.ePos
+			h.e = p.ePos
+		} else if h.partial && h.s < h.e && h.vectorWrapped() {
+			// a vectored Out takes the wrapped record in one write instead of two, without a copy
+			if werr := h.sendParts((*h.cBuf)[h.s:h.e], (*h.cBuf)[p.sPos:p.ePos]); h.err == nil {
+				h.err = werr
+			}
+			h.free(h.e - h.s + p.ePos - p.sPos)
+			h.s = p.ePos
+			h.e = p.ePos
+		} else {
+			if werr := h.emit((*h.cBuf)[h.s:h.e]); h.partial && h.err == nil {
+				h.err = werr
+			}
+			h.free(h.e - h.s)
+			h.s = p.sPos
+			h.e = p.sPos
+		}
+	}
+
+	if l.maxFlushChunkSize > 0 && h.s < h.e && !h.partial && h.e-h.s+p.ePos-p.sPos > l.maxFlushChunkSize {
+		// keep single writes to Out bounded, splitting at the record boundary
+		h.emit((*h.cBuf)[h.s:h.e])
+		h.free(h.e - h.s)
+		h.s = h.e
+	}
+
+	h.partial = p.more
+	if p.sPos < p.ePos && !h.partial {
+		h.pending++
+		h.unwritten++
+	}
+	full := p.ePos-h.s >= h.chunkSize || (l.flushRecordCount > 0 && h.pending >= l.flushRecordCount)
+	// the tail of a wrapped record waits for its head if they are to be written together
+	if !full || (l.boundaryFlushOnly && h.partial) || (h.partial && h.vectorWrapped()) {
+		h.e = p.ePos
+	} else {
+		if werr := h.emit((*h.cBuf)[h.s:p.ePos]); h.err == nil {
+			h.err = werr
+		}
+		h.free(p.ePos - h.s)
+		h.s = p.ePos
+		h.e = p.ePos
+	}
+}
+
+// answer writes everything received so far and answers the done channel of meta: Flush, WriteAndWait, Truncate or Close.
+// It reports whether ioHandler stops.
+func (h *ioState) answer(meta *partMeta) bool {
+	l := h.l
+	if werr := h.releaseHeld(); h.err == nil {
+		h.err = werr
+	}
+	if werr := h.writeOut(); h.err == nil {
+		h.err = werr
+	}
+	if werr := h.drain(); h.err == nil {
+		h.err = werr
+	}
+	if meta.rewind {
+		// Truncate: the buffer is empty and no write can take space in it until done is answered
+		l.muInternal.Lock()
+		if h.cBuf == l.buf {
+			l.startPos = 0
+			l.endPos = 0
+			h.s = 0
+			h.e = 0
+		}
+		l.muInternal.Unlock()
+	}
+	if meta.stop {
+		h.sync()
+	}
+	meta.done <- h.err
+	return meta.stop
+}
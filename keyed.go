@@ -0,0 +1,87 @@
+package logwriter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// WriteKeyed appends the record p framed together with an idempotency key,
+// so a downstream consumer can drop records it has already seen, for example after a writer restart or a replay.
+// The frame is: uvarint(len(key)), key, uvarint(len(p)), p.
+// Keyed and plain records should not be mixed in one Out, because plain records can not be told apart from frames.
+// Use KeyedReader to read the frames back.
+// The return value n is the length of p; err is nil, ErrClosed after Close, ErrRecordTooLarge, ErrRecordOversize,
+// or ErrDropped if ReportErrors is set.
+func (l *LogWriter) WriteKeyed(p []byte, key string) (n int, err error) {
+	if l.oversize(len(p)) {
+		return 0, ErrRecordOversize
+	}
+	frame := make([]byte, 0, len(key)+len(p)+2*binary.MaxVarintLen64)
+	frame = binary.AppendUvarint(frame, uint64(len(key)))
+	frame = append(frame, key...)
+	frame = binary.AppendUvarint(frame, uint64(len(p)))
+	frame = append(frame, p...)
+
+	// frames bypass LineEnding normalization, Encoder, TimestampFormat, RecordPrefix and RecordSuffix
+	return l.result(len(p), l.store(record{2: frame}, nil))
+}
+
+// KeyedReader reads records written with WriteKeyed.
+type KeyedReader struct {
+	// MaxSize is the longest key or record Next accepts, so a damaged length can not make it allocate without bounds.
+	// NewKeyedReader sets it to the default MaxBufSize; raise it for records written with WriteLargeRecords.
+	MaxSize int
+
+	r *bufio.Reader
+}
+
+// NewKeyedReader returns a KeyedReader reading frames from r.
+func NewKeyedReader(r io.Reader) *KeyedReader {
+	return &KeyedReader{MaxSize: defaultMaxBufSize, r: bufio.NewReader(r)}
+}
+
+// Next returns the key and the record of the next frame.
+// At the end of the input Next returns io.EOF; a truncated frame returns io.ErrUnexpectedEOF,
+// and a frame with a key or record longer than MaxSize returns ErrCorrupt.
+func (kr *KeyedReader) Next() (key string, record []byte, err error) {
+	keyLen, err := binary.ReadUvarint(kr.r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	k, err := kr.readN(keyLen)
+	if err != nil {
+		return "", nil, err
+	}
+
+	recordLen, err := binary.ReadUvarint(kr.r)
+	if err != nil {
+		return "", nil, noEOF(err)
+	}
+
+	record, err = kr.readN(recordLen)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(k), record, nil
+}
+
+func (kr *KeyedReader) readN(n uint64) ([]byte, error) {
+	if n > uint64(kr.MaxSize) {
+		return nil, ErrCorrupt
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(kr.r, b); err != nil {
+		return nil, noEOF(err)
+	}
+	return b, nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package logwriter
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestWriteKeyed(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	defer lg.Close()
+
+	lg.WriteKeyed([]byte("test1"), "key1")
+	lg.WriteKeyed([]byte(""), "key2")
+	lg.WriteKeyed([]byte("test3"), "")
+	lg.Flush()
+
+	expected := []struct{ key, record string }{{"key1", "test1"}, {"key2", ""}, {"", "test3"}}
+	kr := NewKeyedReader(&tb.buf)
+	for _, e := range expected {
+		key, record, err := kr.Next()
+		if err != nil || key != e.key || string(record) != e.record {
+			t.Errorf("Expected %q %q, got %q %q %v", e.key, e.record, key, record, err)
+		}
+	}
+
+	if _, _, err := kr.Next(); err != io.EOF {
+		t.Error("Expected io.EOF, got", err)
+	}
+
+	kr = NewKeyedReader(bytes.NewReader([]byte{4, 'k', 'e'}))
+	if _, _, err := kr.Next(); err != io.ErrUnexpectedEOF {
+		t.Error("Expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+func TestKeyedReaderCorrupt(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"truncated key length", []byte{0x80}, io.ErrUnexpectedEOF},
+		{"truncated record length", []byte{1, 'k'}, io.ErrUnexpectedEOF},
+		{"truncated record", []byte{1, 'k', 5, 't', 'e'}, io.ErrUnexpectedEOF},
+		{"key length out of range", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, ErrCorrupt},
+		{"record length above MaxSize", []byte{1, 'k', 0x80, 0x80, 0x80, 0x80, 0x01}, ErrCorrupt},
+	} {
+		kr := NewKeyedReader(bytes.NewReader(c.input))
+		if _, _, err := kr.Next(); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	kr := NewKeyedReader(bytes.NewReader([]byte{1, 'k', 5, 't', 'e', 's', 't', '1'}))
+	kr.MaxSize = 4
+	if _, _, err := kr.Next(); err != ErrCorrupt {
+		t.Error("Expected ErrCorrupt for a record longer than MaxSize, got", err)
+	}
+}
@@ -0,0 +1,54 @@
+package logwriter
+
+import "sync/atomic"
+
+// LeveledWriter is an io.Writer that drops the records below a minimum level before they reach the buffer of a LogWriter.
+// The LogWriter itself knows nothing about levels: the level of a record is given to WriteLevel,
+// or found by the LevelFunc for records passed to Write.
+// Dropped records take no space in the buffer and are counted in Metrics.LevelDroppedRecords, not as skipped.
+// A LeveledWriter is safe for concurrent use; several of them, with their own minimum levels, may share one LogWriter.
+type LeveledWriter struct {
+	l         *LogWriter
+	minLevel  atomic.Int64
+	levelFunc func(p []byte) int
+}
+
+// Leveled returns a LeveledWriter that passes to the LogWriter the records of minLevel and above.
+// levelFunc, if not nil, gives the level of a record passed to Write, for example by parsing its prefix;
+// without it, Write passes every record.
+func (l *LogWriter) Leveled(minLevel int, levelFunc func(p []byte) int) *LeveledWriter {
+	w := &LeveledWriter{l: l, levelFunc: levelFunc}
+	w.minLevel.Store(int64(minLevel))
+	return w
+}
+
+// SetMinLevel changes the minimum level, for example to turn on debug records for a while.
+func (w *LeveledWriter) SetMinLevel(level int) {
+	w.minLevel.Store(int64(level))
+}
+
+// Enabled reports whether records of level are passed to the LogWriter.
+// Check it before formatting a costly record.
+func (w *LeveledWriter) Enabled(level int) bool {
+	return int64(level) >= w.minLevel.Load()
+}
+
+// WriteLevel writes p to the LogWriter if level is enabled, as its Write does.
+// A dropped record returns len(p) and nil, as if it was written.
+func (w *LeveledWriter) WriteLevel(level int, p []byte) (n int, err error) {
+	if !w.Enabled(level) {
+		if len(p) > 0 {
+			w.l.metrics.levelDroppedRecords.Add(1)
+		}
+		return len(p), nil
+	}
+	return w.l.Write(p)
+}
+
+// Write writes p at the level given by the LevelFunc, or passes it if there is none.
+func (w *LeveledWriter) Write(p []byte) (n int, err error) {
+	if w.levelFunc == nil || len(p) == 0 {
+		return w.l.Write(p)
+	}
+	return w.WriteLevel(w.levelFunc(p), p)
+}
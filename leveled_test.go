@@ -0,0 +1,44 @@
+package logwriter
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLeveledWriter(t *testing.T) {
+	const (
+		debug = iota
+		info
+		errorLevel
+	)
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	defer lg.Close()
+	levelOf := func(p []byte) int {
+		if bytes.HasPrefix(p, []byte("E ")) {
+			return errorLevel
+		}
+		return info
+	}
+	lw := lg.Leveled(info, levelOf)
+
+	if lw.Enabled(debug) || !lw.Enabled(errorLevel) {
+		t.Error("Expected debug disabled and error enabled")
+	}
+	lw.WriteLevel(debug, []byte("test1"))
+	lw.WriteLevel(info, []byte("test2"))
+	if n, err := lw.WriteLevel(debug, []byte("test3")); n != 5 || err != nil {
+		t.Error("Expected 5, nil for a dropped record, got", n, err)
+	}
+	lw.SetMinLevel(errorLevel)
+	lw.Write([]byte("I test4"))
+	lw.Write([]byte("E test5"))
+	lg.Close()
+
+	if tb.buf.String() != "test2E test5" {
+		t.Error("Expected output = test2E test5, got", tb.buf.String())
+	}
+	if m := lg.Metrics(); m.LevelDroppedRecords != 3 || m.Records != 2 || m.SkippedRecords != 0 {
+		t.Error("Expected 3 records dropped by level and 2 written, got", m)
+	}
+}
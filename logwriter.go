@@ -6,22 +6,118 @@
 package logwriter
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 const (
 	defaultMaxBufSize      = 32 * (1 << 20) // 32 MB
 	defaultMaxRecordsInBuf = 500000
 	defaultFlashPeriod     = 100 * time.Millisecond
+	defaultChunkSize       = 4096
+	minFlashPeriod         = time.Millisecond
+	defaultCircuitCooldown = time.Second
+	defaultMaxLineDelay    = time.Second
+	defaultHealthWindow    = 10 * time.Second
 )
 
+var (
+	// ErrClosed is returned by writes to a closed LogWriter.
+	ErrClosed = errors.New("logwriter: closed")
+	// ErrDropped is returned by writes of a record that was skipped because it did not fit into the buffer.
+	// Write returns it only if ReportErrors is set.
+	ErrDropped = errors.New("logwriter: record dropped")
+	// ErrRecordTooLarge is returned by writes of a record larger than the whole buffer, which can never be buffered.
+	// It wraps ErrDropped, but unlike it, Write returns it even if ReportErrors is not set.
+	ErrRecordTooLarge = fmt.Errorf("%w: record is larger than the buffer", ErrDropped)
+	// ErrRecordOversize is returned by writes of a record longer than MaxRecordSize. Like ErrRecordTooLarge,
+	// it wraps ErrDropped and is returned even if ReportErrors is not set.
+	ErrRecordOversize = fmt.Errorf("%w: record is larger than MaxRecordSize", ErrDropped)
+	// ErrCloseTimeout is returned by CloseWithTimeout when the buffered records could not be written in time.
+	ErrCloseTimeout = errors.New("logwriter: close timed out, unwritten records abandoned")
+	// ErrWritePanic is wrapped by the PanicError of a write to Out that panicked.
+	ErrWritePanic = errors.New("logwriter: Out panicked")
+	// ErrWriteTimeout is the write error of a write to Out that took longer than WriteTimeout.
+	ErrWriteTimeout = errors.New("logwriter: write to Out timed out")
+	// ErrInvalidConfig is wrapped by the errors of NewWithError.
+	ErrInvalidConfig = errors.New("logwriter: invalid config")
+	// ErrCircuitOpen is the write error of the records discarded while the circuit breaker is open (CircuitThreshold),
+	// returned by WriteAndWait and Flush for them.
+	ErrCircuitOpen = errors.New("logwriter: circuit open, Out is not written")
+	// ErrCorrupt is returned by KeyedReader.Next for a frame whose key or record is longer than MaxSize,
+	// which a damaged or foreign input can claim.
+	ErrCorrupt = errors.New("logwriter: corrupt keyed frame")
+)
+
+// errSpill tells that a record which does not fit into the buffer is to be written to OverflowWriter.
+var errSpill = errors.New("logwriter: record spilled")
+
+// errSampled tells that a record was dropped by SamplingRate.
+var errSampled = errors.New("logwriter: record sampled out")
+
+// PanicError is the error of a write to Out that panicked. It carries the recovered value and wraps ErrWritePanic.
+type PanicError struct {
+	Value any    // the value passed to panic
+	Stack []byte // the stack of the goroutine that panicked, as formatted by runtime/debug.Stack
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrWritePanic, e.Value)
+}
+
+func (e *PanicError) Unwrap() error {
+	return ErrWritePanic
+}
+
 type part struct {
-	pBuf *[]byte
-	sPos int
-	ePos int
-	out  io.Writer
+	pBuf  *[]byte
+	sPos  int
+	ePos  int
+	out   io.Writer
+	input chan part
+	more  bool      // the record continues in the next part (wrapped around the buffer end)
+	tail  bool      // the part continues the record of the previous part
+	meta  *partMeta // optional data of the record, set on its last part
+}
+
+// record holds the pieces of a record, copied to the buffer one after another:
+// RecordPrefix, the timestamp, the payload, the line ending and RecordSuffix. Unused pieces are nil.
+type record [5][]byte
+
+func (r *record) len() int {
+	n := 0
+	for _, b := range r {
+		n += len(b)
+	}
+	return n
+}
+
+// partMeta carries optional per-record data.
+// It is nil for plain records, so they pay only for the pointer in the part.
+type partMeta struct {
+	done   chan error    // receives the result of writing the record
+	out    io.Writer     // if set, the data before the part goes to the current Out, and the data after it to this one
+	window time.Duration // if positive, the data after the part goes to both Outs for this time, then to out only
+	stop   bool          // Close: write what is left and stop ioHandler
+
+	drained chan struct{} // Reset: closed when ioHandler reaches the part, after the old Out has got all its records
+	flushed int           // Reset: set before drained is closed to the bytes written to the Outs replaced since the last such part
+	fresh   bool          // Reset: the first part of a new buffer
+	grown   bool          // InitialBufSize: the new buffer is a larger one for the same Out, which goes on as before
+	period  time.Duration // ResetConfig: if positive, the new FlashPeriod, set with the new buffer
+	rewind  bool          // Truncate: once everything is written, the buffer starts over at its beginning
+	direct  []byte        // WriteLargeRecords: a record larger than the buffer, written to Out by itself
 }
 
 func (p *part) setPart(b *[]byte, s int, e int, o io.Writer) {
@@ -31,6 +127,55 @@ func (p *part) setPart(b *[]byte, s int, e int, o io.Writer) {
 	p.out = o
 }
 
+// LineEnding selects how LogWriter normalizes the line ending at the end of each record.
+type LineEnding int
+
+const (
+	// LineEndingKeep leaves records as they are.
+	LineEndingKeep LineEnding = iota
+	// LineEndingLF ends every record with "\n".
+	LineEndingLF
+	// LineEndingCRLF ends every record with "\r\n".
+	LineEndingCRLF
+	// LineEndingNone removes a trailing "\n" or "\r\n" from every record.
+	LineEndingNone
+)
+
+var lineEndings = [...][]byte{LineEndingLF: []byte("\n"), LineEndingCRLF: []byte("\r\n"), LineEndingNone: nil}
+
+// TimestampUnixNano is a TimestampFormat that stamps records with the nanoseconds since the Unix epoch, for machine parsing.
+const TimestampUnixNano = "unixnano"
+
+// OverflowPolicy selects what Write does when a record does not fit into the buffer.
+type OverflowPolicy int
+
+const (
+	// OverflowSkip skips the record and calls SkipHandler; Write never blocks.
+	OverflowSkip OverflowPolicy = iota
+	// OverflowBlock makes Write wait until there is space for the record.
+	// Writing to the LogWriter from WriteErrorHandler, SkipHandler or any other handler then deadlocks
+	// once the buffer is full, because space is freed only by the goroutine that calls the handlers.
+	OverflowBlock
+	// OverflowDropOldest discards the oldest queued records to make room for the new one.
+	OverflowDropOldest
+)
+
+// SkipReason tells SkipReasonHandler why records were lost.
+type SkipReason int
+
+const (
+	// SkippedNewest means the new record did not fit into the buffer and was skipped.
+	SkippedNewest SkipReason = iota
+	// DroppedOldest means queued records were discarded to make room for a new one (OverflowDropOldest).
+	DroppedOldest
+	// SkippedBusy means TryWrite skipped the record because another writer was using the buffer.
+	SkippedBusy
+	// SkippedTooLarge means the record was larger than the whole buffer (ErrRecordTooLarge).
+	SkippedTooLarge
+	// DroppedCircuitOpen means buffered records were discarded instead of being written because the circuit was open (ErrCircuitOpen).
+	DroppedCircuitOpen
+)
+
 // LogConfig encapsulates initializing parameters for the LogWriter.
 // The most important is Out, there LogWriter tries to write logs. Out is the only required parameter.
 // Callback WriteErrorHandler is called if an error occurred while writing to the Out.
@@ -39,46 +184,393 @@ func (p *part) setPart(b *[]byte, s int, e int, o io.Writer) {
 // In some cases, WriteErrorHandler can be used for re-opening a file or a network connection.
 // Do not try to write to the log from SkipHandler or WriteErrorHandler, this can be dangerous.
 // Parameters MaxBufSize and MaxRecordsInBuf allow you to control the size of the buffer.
-// LogWriter tries to send large chunks to Out, but if 4096 bytes is not entered and there is no new data, the buffer will be written after FlashPeriod.
+// LogWriter tries to send large chunks to Out, but if ChunkSize bytes is not entered and there is no new data, the buffer will be written after FlashPeriod.
+// Zero sizes and periods mean the defaults, negative ones are rejected by NewWithError.
 type LogConfig struct {
-	Out               io.Writer
+	Out io.Writer
+	// Outs are more outputs that receive a copy of every record. Each of them gets its own buffer and goroutine
+	// with the same settings, so a slow output does not hold back the others. Write reports the result for Out only.
+	Outs []io.Writer
+	// WriteErrorHandler is called from the background goroutine, so with OverflowBlock a write to the LogWriter
+	// from it deadlocks once the buffer is full.
 	WriteErrorHandler func(io.Writer)
+	// ReopenHandler, if set, is called with Out after WriteErrorHandler when a write to Out fails; if it returns a new io.Writer
+	// without error, LogWriter switches to it, writes the HeaderFunc header and retries the failed write once.
+	// The failed Out is not closed by LogWriter. ReopenHandler is not called while the circuit is open.
+	ReopenHandler func(io.Writer) (io.Writer, error)
+	// PostWriteHandler, if set, is called after every successful write to Out (or to a mirror of MigrateTo) with the Out
+	// and the number of bytes, for example to Sync a file or to flush a bufio.Writer wrapped around the real sink.
+	// It is called from the background goroutine without locks held; a panic in it is recovered and reported to InternalLogger.
+	PostWriteHandler func(out io.Writer, n int)
+	// If RetryCount is positive, a failed write is repeated up to RetryCount times, RetryDelay apart, before it counts as failed.
+	// The data stays in the buffer while it is retried, so new records may be skipped (or wait, with OverflowBlock) in the meantime.
+	RetryCount int
+	RetryDelay time.Duration
+	// If WriteTimeout is positive, a write to Out that takes longer fails with ErrWriteTimeout, so a stalled Out does not hold up
+	// the buffer; it counts as a write error, so WriteErrorHandler and ReopenHandler are called as usual.
+	// The timed out write keeps running in its own goroutine with a copy of the data, and may still complete (late, or in part);
+	// until it returns, further writes to the same Out fail at once with ErrWriteTimeout instead of calling Out concurrently.
+	WriteTimeout time.Duration
+	// If Out has a Sync method, such as *os.File, and SyncInterval or SyncBytes is positive, LogWriter calls Sync after writing to Out
+	// once SyncInterval has passed since the last Sync (checked every FlashPeriod) or SyncBytes bytes have been written since then,
+	// which bounds the data lost on a power failure. Out is also synced before it is replaced and on Close. A failed Sync is reported
+	// like a write error, to InternalLogger, the write error handlers and Healthy, but does not count for CircuitThreshold.
+	// An Out without Sync is written as usual.
+	SyncInterval time.Duration
+	SyncBytes    int64
+	// SkipHandler is called with the number of records lost because the buffer was full (SkippedNewest and DroppedOldest),
+	// under every OverflowPolicy. SkipReasonHandler, if set, gets the records lost for every SkipReason, with the reason;
+	// Metrics counts each reason apart, so a record larger than the buffer is not taken for an overloaded buffer.
 	SkipHandler       func(int)
-	MaxBufSize        int
-	MaxRecordsInBuf   int
-	FlashPeriod       time.Duration
+	SkipReasonHandler func(n int, reason SkipReason)
+	// SkipHandlerBytes, if set, is called with each lost record, for example to sample them to a side channel.
+	// The slice is only valid during the call (it may be the slice passed to Write) and must be copied to be kept.
+	// Records discarded by OverflowDropOldest are copied for it, so it costs nothing only when it is not set.
+	SkipHandlerBytes func(record []byte)
+	// OnBackpressure, if set, is called with true once LogWriter starts skipping new records because the buffer is full,
+	// and with false once it accepts them again, so a single event can be logged instead of every lost record.
+	// Calls alternate and are made without internal locks held, one at a time. Only the buffer of Out is watched, not those of Outs.
+	OnBackpressure func(active bool)
+	// If SamplingRate is above 1, LogWriter samples records instead of skipping them all while skipping is on:
+	// it keeps trying to buffer 1 in SamplingRate records and drops the others without trying, so a flood still leaves
+	// representative records in the log. With SampleAlways the records are sampled all the time, not only under load.
+	// Sampled out records are passed to SampledHandler (the number, one at a time) and counted in Metrics.SampledRecords,
+	// not reported as skipped; Write returns for them like for a skipped record. Sampling does not apply with OverflowBlock.
+	SamplingRate   int
+	SampleAlways   bool
+	SampledHandler func(n int)
+	MaxBufSize     int
+	// If InitialBufSize is positive and smaller than MaxBufSize, the buffer starts with InitialBufSize bytes (at least 2)
+	// and is replaced by one twice as large, up to MaxBufSize, whenever a record does not fit, so a mostly idle LogWriter
+	// does not hold the whole MaxBufSize. The records of the old buffer are written to Out before those of the new one,
+	// as after SetMaxBufSize, but Out does not see the switch: no header is written and RotateBytes keeps counting.
+	// Stats.MaxBufSize is the current size; SetMaxBufSize and ResetConfig fix the size and end the growth.
+	InitialBufSize  int
+	MaxRecordsInBuf int
+	// ChannelCapacity is the number of parts in the channel that passes records to the background goroutine
+	// (MaxRecordsInBuf+2 by default, at least 3). Each slot takes about 64 bytes whether it is used or not,
+	// so the default MaxRecordsInBuf costs about 32 MB; when the buffer of MaxBufSize bytes is the real limit,
+	// a smaller ChannelCapacity saves this memory. The number of queued records is limited by the smaller of MaxRecordsInBuf
+	// and ChannelCapacity-1 (ChannelCapacity-2 for a record that wraps around the end of the buffer and takes two parts),
+	// and new records are skipped (or wait, with OverflowBlock) beyond it instead of waiting for room in the channel.
+	ChannelCapacity int
+	// FlashPeriod below 1ms is raised to 1ms to avoid spinning the ticker.
+	FlashPeriod time.Duration
+	// ChunkSize is 4096 by default and can not exceed MaxBufSize; a larger value is lowered to MaxBufSize.
+	ChunkSize int
+	// If FlushRecordCount is positive, the buffer is also written as soon as that many records have been received since
+	// the last write, for small but frequent records that would take long to make up ChunkSize.
+	FlushRecordCount int
+	// FlushJitter, if positive, changes every FlashPeriod interval by a random fraction of up to ±FlushJitter (0.1 for ±10%),
+	// so that many LogWriters created at once do not all flush at the same moments. It must be less than 1.
+	FlushJitter float64
+	// OverflowPolicy selects between skipping records when the buffer is full (the default), blocking Write until there is space
+	// and discarding the oldest records that are not being written yet (OverflowDropOldest).
+	// A record that can never fit into the buffer is skipped under all policies.
+	OverflowPolicy OverflowPolicy
+	// Write returns (len(p), nil) for a skipped record, unless ReportErrors is set: then it returns (0, ErrDropped).
+	ReportErrors bool
+	// A record larger than MaxBufSize-1 bytes can never fit: it is skipped without turning on skipping of the records after it,
+	// InternalLogger is told, and Write returns (0, ErrRecordTooLarge) in any case.
+	// If WriteLargeRecords is set, such a record is not skipped: it is copied and queued by itself, outside the buffer,
+	// and written to Out with a write of its own after the records buffered before it and before the records buffered after it,
+	// in the same order as if it had fit. The copies are not limited by MaxBufSize, so only occasional large records,
+	// such as long stack traces, should rely on it.
+	WriteLargeRecords bool
+	// If MaxRecordSize is positive, a record longer than MaxRecordSize bytes is dropped before any other work, for example
+	// to guard against a runaway formatter: OversizeHandler, if set, is called with its length, it is counted in
+	// Metrics.OversizeRecords, not as skipped, and the write returns ErrRecordOversize. WriteRecords drops such records
+	// and writes the others, and returns ErrRecordOversize if nothing else went wrong. ReadFrom is not limited by MaxRecordSize.
+	MaxRecordSize   int
+	OversizeHandler func(n int)
+	// If OverflowWriter is set, records are not lost to a full buffer: a record that would be skipped (including one larger than
+	// the buffer) is written to OverflowWriter instead, synchronously by the writing goroutine, so Write waits for it then.
+	// Spilled records are counted in Metrics.SpilledRecords, not as skipped; a record that can not be written to OverflowWriter
+	// either is skipped as usual. Spilled records are not ordered with the records in Out: a record spilled while the buffer is full
+	// is usually in OverflowWriter before older buffered records reach Out. Records dropped by OverflowDropOldest
+	// and skipped by TryWrite because the buffer is busy are not spilled. OverflowWriter is used for Out only, not for Outs.
+	OverflowWriter io.Writer
+	// If ResetBlocksWrites is set, Reset holds off new writes while it switches to the new Out (see Reset).
+	ResetBlocksWrites bool
+	// HeaderFunc, if set, is called for every new Out (in New and on each Reset) and its result is written first to that Out,
+	// for example a CSV header or a session banner.
+	HeaderFunc func() []byte
+	// If CircuitThreshold is positive, after that many consecutive write errors LogWriter stops writing to Out for CircuitCooldown
+	// (1 second by default) and discards the data it would have written; then a single probe write decides whether to resume or wait again.
+	// The discarded records are reported as skipped with the reason DroppedCircuitOpen, and their bytes are counted in Metrics.
+	CircuitThreshold int
+	CircuitCooldown  time.Duration
+	// HealthWindow (10 seconds by default) is how long a write error makes Healthy report false.
+	HealthWindow time.Duration
+	// If StallTimeout is positive and StallHandler is set, a watchdog goroutine calls StallHandler when records are waiting
+	// but nothing has been written to Out successfully for StallTimeout, for example because a write to Out hangs;
+	// the argument is the time since the last successful write. The check runs every StallTimeout/2,
+	// and StallHandler is called once per stall, again only after a write has succeeded.
+	StallTimeout time.Duration
+	StallHandler func(stalled time.Duration)
+	// If BoundaryFlushOnly is set, every write to Out contains only whole records:
+	// a record wrapped around the end of the buffer is joined into one write instead of being written in two pieces.
+	// An Out that implements WritevWriter, or is a TCP or Unix connection, gets the two pieces of a wrapped record with one vectored write
+	// instead of a joined copy, and, even without BoundaryFlushOnly, instead of two writes, unless LineBuffered or OutBufferSize is set.
+	BoundaryFlushOnly bool
+	// If AtomicRecords is set, every record is written to Out with a single write of its own, for sinks that take each write as one line:
+	// records are not coalesced, and a wrapped record is joined as with BoundaryFlushOnly. ChunkSize has no effect then.
+	AtomicRecords bool
+	// If ImmediateFlush is set, every record is written to Out as soon as the background goroutine receives it, without coalescing
+	// (a wrapped record still takes two writes, unless with BoundaryFlushOnly); it trades throughput for latency.
+	// ChunkSize and FlashPeriod have no effect then, and no ticker is run, unless LineBuffered or RotateInterval need one;
+	// a MigrateTo window ends with the first record after it.
+	ImmediateFlush bool
+	// If AdaptiveFlush is set, the FlashPeriod ticker runs only while there is something to write: it is stopped once
+	// the buffer is written and started again by the next record, so an idle LogWriter causes no timer wakeups.
+	// The first FlashPeriod flush after a pause comes FlashPeriod after the first record, not at the next tick of a fixed schedule.
+	// The ticker keeps running with RotateInterval and during a MigrateTo window.
+	AdaptiveFlush bool
+	// If OutBufferSize is positive, small writes to Out are collected, up to OutBufferSize bytes, and written together,
+	// like with a bufio.Writer around Out, for sinks that make a system call per write: it helps when the buffer is written
+	// in small pieces, with a small ChunkSize, FlushOnIdle or frequent WriteAndWait calls. The collected data is written
+	// every FlashPeriod and at once by Flush, Close, WriteAndWait, FlushSignal and a switch of Out, so nothing is left in it at shutdown.
+	// A write error of collected data is reported when they are written. OutBufferSize has no effect with ImmediateFlush or AtomicRecords.
+	OutBufferSize int
+	// If LineBuffered is set, bytes after the last "\n" are held back until the rest of the line comes, so readers of Out see whole lines.
+	// A partial line is written anyway after MaxLineDelay (1 second by default), and at once by Flush, Close, WriteAndWait and a switch of Out.
+	LineBuffered bool
+	MaxLineDelay time.Duration
+	// LineEnding normalizes the trailing line ending of each record written with Write or WriteAndWait.
+	LineEnding LineEnding
+	// RecordPrefix and RecordSuffix, if set, are written before and after each such record (after the line ending),
+	// for example a separator or a header of a binary protocol. They take space in the buffer like the record itself.
+	RecordPrefix []byte
+	RecordSuffix []byte
+	// If TimestampFormat is set, each such record starts (after RecordPrefix) with the time of the Write call
+	// formatted with this layout of time.Format, or in nanoseconds since the Unix epoch for TimestampUnixNano, and a space.
+	TimestampFormat string
+	// Encoder, if set, serializes the payload of each such record before it is buffered, after the line ending is normalized,
+	// for example into a JSON object with JSONEncoder. The encoded length is what takes space in the buffer.
+	Encoder Encoder
+	// If DeferFlushWhileBusy is set, the FlashPeriod flush is skipped while more records are queued,
+	// so they coalesce into larger writes under steady load; an idle writer is still flushed after FlashPeriod.
+	DeferFlushWhileBusy bool
+	// If FlushOnIdle is set, the buffer is written as soon as no more records are queued,
+	// so records coalesce during bursts and the last record of a burst does not wait for FlashPeriod.
+	FlushOnIdle bool
+	// FlushSignal, if set, makes the background goroutine write the buffer on every receive from it, as the FlashPeriod ticker does,
+	// for example right before taking a snapshot. Unlike Flush, it does not wait: records still queued when the signal arrives
+	// are written by the next flush. A closed FlushSignal is ignored. It applies to Out only, not to Outs.
+	FlushSignal <-chan struct{}
+	// If FlushOnEmptyWrite is set, an empty Write requests a write of the buffer to Out without waiting for it.
+	FlushOnEmptyWrite bool
+	// MaxFlushChunkSize, if positive, limits the size of a single write to Out; longer runs of records are split at record boundaries.
+	// A record longer than MaxFlushChunkSize is still written in one piece (or two, if it wraps around the buffer end).
+	MaxFlushChunkSize int
+	// InternalLogger, if set, receives messages about problems of LogWriter itself (a full buffer, a panicking Out,
+	// an open circuit, a failed rotation). It is never called with internal locks held, but like the other handlers
+	// it must not write to this LogWriter.
+	InternalLogger func(msg string)
+	// If ExpvarPrefix is set, the record, skip and write error counters of Metrics and the buffered bytes of Len
+	// are published in the expvar map "logwriter" under the key ExpvarPrefix (ExpvarPrefix.Name if Name is set),
+	// as an object with records, skipped, write_errors and buffer_used.
+	// If another open LogWriter already uses the key, a suffix "_2", "_3" and so on is added to it and InternalLogger is told.
+	// The key is removed on Close, so a closed LogWriter can be garbage collected and its key used again.
+	ExpvarPrefix string
+
+	// WriteErrorHandlerErr, if set, is called after WriteErrorHandler with the error of the write as well;
+	// the error of a panicking Out is a *PanicError with the recovered value, so errors.As tells a bug in Out from, for example, a full disk.
+	WriteErrorHandlerErr func(out io.Writer, err error)
+	// RecoverHandler, if set, is called with the recovered value and the stack of a panicking Out before the write error handlers,
+	// to find the bug in Out; without it the panic is only turned into the error.
+	RecoverHandler func(recovered any, stack []byte)
+	// SinkSkipHandler and SinkWriteErrorHandler are called like SkipHandler and WriteErrorHandler (which still get the events
+	// of all outputs), with the index of the output: 0 for Out and i+1 for Outs[i].
+	SinkSkipHandler       func(sink int, n int)
+	SinkWriteErrorHandler func(sink int, out io.Writer)
+
+	// Name, if set, names the LogWriter for processes that run many of them: it is in Metrics, in the expvar key
+	// (ExpvarPrefix.Name), and NamedSkipHandler and NamedWriteErrorHandler get it with every event,
+	// so one function can serve all the LogWriters. NamedSkipHandler is called with the same events as SkipReasonHandler,
+	// NamedWriteErrorHandler with the same as WriteErrorHandlerErr. The LogWriters of Outs are named Name/1, Name/2 and so on.
+	Name                   string
+	NamedSkipHandler       func(name string, n int, reason SkipReason)
+	NamedWriteErrorHandler func(name string, out io.Writer, err error)
+
+	// If RotateAt (times of day as "15:04" or "15:04:05", local time) and RotateFilenameFunc are set,
+	// at each of these times LogWriter opens the file named by RotateFilenameFunc for the rotation time and switches to it with Reset.
+	// Files opened this way are closed after the next rotation; the initial Out is left to the caller.
+	// If the file can not be opened, LogWriter keeps writing to the current Out until the next rotation.
+	// New panics if a RotateAt time can not be parsed, NewWithError returns an error.
+	RotateAt           []string
+	RotateFilenameFunc func(time.Time) string
+	// If RotateBytes is positive and RotateHandler is set, RotateHandler is called with Out once RotateBytes bytes of records
+	// have been written to it; if it returns a new io.Writer without error, LogWriter writes the HeaderFunc header to it
+	// and writes the following records there. Everything written before goes to the old Out, which is left to RotateHandler,
+	// and a record is never split between the two. The count starts again for the new Out, and after a failed rotation too.
+	// If RotateInterval is positive and RotateHandler is set, RotateHandler is also called every RotateInterval, for example
+	// for hourly or daily files. With RotateAligned the rotations fall on multiples of RotateInterval in local time
+	// (on the hour, at midnight), otherwise they are counted from New. The time is checked every FlashPeriod.
+	RotateBytes    int64
+	RotateInterval time.Duration
+	RotateAligned  bool
+	RotateHandler  func(io.Writer) (io.Writer, error)
+
+	clock clock // the real clock if nil; set by tests to control time
 }
 
-// LogWriter encapsulates the circular buffer for fast writes to memory. LogWriter implements io.Writer interface.
+var (
+	_ io.WriteCloser = (*LogWriter)(nil)
+	_ io.ReaderFrom  = (*LogWriter)(nil)
+)
+
+// LogWriter encapsulates the circular buffer for fast writes to memory. *LogWriter implements io.WriteCloser interface.
 // Multiple goroutines may invoke methods on a LogWriter simultaneously.
+// Records reach Out in the order in which their writes took the buffer: a write copies its record and queues it
+// in one step under a lock, and the background goroutine writes the queue in order. So the records of one goroutine
+// are never reordered, and of two writes that do not overlap in time the earlier one is written first.
+// The order of writes that overlap is decided by the lock and is not specified otherwise.
+// The exceptions are records spilled to OverflowWriter, records in the old Out after Reset without ResetBlocksWrites
+// (see Reset), and Outs, which get the records in the same order per goroutine, but may interleave concurrent writes differently.
 type LogWriter struct {
 	out io.Writer
 	buf *[]byte
 
-	skipHandler       func(int)
-	writeErrorHandler func(io.Writer)
+	skipHandler          func(int)
+	skipReasonHandler    func(int, SkipReason)
+	skipHandlerBytes     func([]byte)
+	writeErrorHandler    func(io.Writer)
+	writeErrorHandlerErr func(io.Writer, error)
+	recoverHandler       func(recovered any, stack []byte)
+	name                 string
+	namedSkipHandler     func(string, int, SkipReason)
+	namedErrorHandler    func(string, io.Writer, error)
+	reopenHandler        func(io.Writer) (io.Writer, error)
+	postWriteHandler     func(io.Writer, int)
+	retryCount           int
+	retryDelay           time.Duration
+	writeTimeout         time.Duration
+	syncInterval         time.Duration
+	syncBytes            int64
+	muHung               sync.Mutex   // guards hung
+	hung                 []*hungWrite // writes given up after writeTimeout that have not returned yet
 
 	muInput      sync.Mutex
 	inputRecords chan part
-	ioInfo       chan struct{}
+	// queued are parts put in order under muInternal, which must not wait for room in inputRecords while ioHandler needs the lock;
+	// the next sender under muInput sends them before its own parts
+	queued []part
+	// channelCapacity is ChannelCapacity, or 0 to follow maxRecordsInBuf
+	channelCapacity int
 
 	muInternal sync.Mutex
 	startPos   int
 	endPos     int
 	skipping   bool
+	closed     bool          // set under both muInput and muInternal
+	abandoned  atomic.Bool   // set by CloseWithTimeout: nothing more is written to Out
+	resetLeft  atomic.Bool   // set if the last reset stopped waiting for the old Out, see LastResetDrained
+	wrapped    uint64        // records split in two parts at the end of the buffer
+	highWater  int           // the most bytes used in the buffer at once
+	lastError  time.Time     // the time of the last failed write to Out, for Healthy
+	progress   atomic.Int64  // the time of the last successful write to Out in Unix nanoseconds, for StallTimeout
+	done       chan struct{} // closed when ioHandler stops
+
+	// spaceFreed is signaled when buffer space is freed; blocked writers are served in the order of blockQueue
+	spaceFreed *sync.Cond
+	blockNext  uint64
+	blockQueue []uint64
+
+	occupancy [OccupancyBuckets]uint64
+	metrics   metrics
 
 	maxBufSize      int
+	growTo          int // MaxBufSize while the buffer grows from InitialBufSize, or 0
 	maxRecordsInBuf int
-	flashPeriod     time.Duration
+	flashPeriod     time.Duration // changed by ResetConfig under muInternal
+	flushJitter     float64
+	chunkSize       int
+
+	resetBlocksWrites   bool
+	flushRecordCount    int
+	headerFunc          func() []byte
+	breaker             circuit
+	healthWindow        time.Duration
+	stallTimeout        time.Duration
+	stallHandler        func(stalled time.Duration)
+	boundaryFlushOnly   bool
+	immediateFlush      bool
+	adaptiveFlush       bool
+	outBufferSize       int
+	lineBuffered        bool
+	maxLineDelay        time.Duration
+	lineEnding          LineEnding
+	recordPrefix        []byte
+	recordSuffix        []byte
+	timestampFormat     string
+	encoder             Encoder
+	deferFlushWhileBusy bool
+	flushOnIdle         bool
+	flushSignal         <-chan struct{}
+	flushOnEmptyWrite   bool
+	maxFlushChunkSize   int
+	internalLogger      func(msg string)
+	overflowPolicy      OverflowPolicy
+	clock               clock
+	reportErrors        bool
+	writeLargeRecords   bool
+	maxRecordSize       int
+	oversizeHandler     func(n int)
+	overflowWriter      io.Writer
+
+	muSpill  sync.Mutex // serializes writes to overflowWriter
+	spillBuf []byte     // a spilled record joined from its pieces, under muSpill
+
+	rotateBytes    int64
+	rotateInterval time.Duration
+	rotateAligned  bool
+	rotateHandler  func(io.Writer) (io.Writer, error)
+
+	sinks []*LogWriter // the LogWriters of Outs
+
+	config LogConfig // as passed to New, for Config
+
+	expvarPrefix string // the key in the expvar map, under muExpvar
+
+	onBackpressure func(active bool)
+	muBackpressure sync.Mutex
+	backpressure   bool // the state last reported to onBackpressure
+
+	samplingRate   int
+	sampleAlways   bool
+	sampledHandler func(n int)
+	sampleCount    uint64 // records seen while sampling, under muInput
+
+	muTail     sync.Mutex
+	tailers    []chan []byte
+	numTailers int32
 }
 
 // New creates a new LogWriter with parameters from LogConfig.
+// It panics if the config is invalid, see NewWithError, rather than failing later in the background goroutine.
 func New(config LogConfig) *LogWriter {
+	l, err := NewWithError(config)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// NewWithError is like New, but returns an error wrapping ErrInvalidConfig instead of panicking if the config is invalid:
+// Out or one of Outs is nil, MaxBufSize, InitialBufSize, MaxRecordsInBuf, ChannelCapacity, FlashPeriod, StallTimeout,
+// MaxRecordSize, SyncInterval or SyncBytes is negative, FlushJitter is not in [0, 1), or a RotateAt time can not be parsed.
+func NewWithError(config LogConfig) (*LogWriter, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
 
 	l := &LogWriter{out: config.Out,
 		maxBufSize:      config.MaxBufSize,
 		maxRecordsInBuf: config.MaxRecordsInBuf,
-		flashPeriod:     config.FlashPeriod}
+		flashPeriod:     config.FlashPeriod,
+		flushJitter:     config.FlushJitter,
+		chunkSize:       config.ChunkSize}
 
 	if l.maxBufSize == 0 {
 		l.maxBufSize = defaultMaxBufSize
@@ -90,190 +582,1756 @@ func New(config LogConfig) *LogWriter {
 
 	if l.flashPeriod == 0 {
 		l.flashPeriod = defaultFlashPeriod
+	} else if l.flashPeriod < minFlashPeriod {
+		l.flashPeriod = minFlashPeriod
+	}
+
+	if l.chunkSize <= 0 {
+		l.chunkSize = defaultChunkSize
+	}
+
+	if l.chunkSize > l.maxBufSize {
+		l.chunkSize = l.maxBufSize
+	}
+
+	if config.InitialBufSize > 0 && config.InitialBufSize < l.maxBufSize {
+		l.growTo = l.maxBufSize
+		l.maxBufSize = max(config.InitialBufSize, 2)
 	}
 
 	b := make([]byte, l.maxBufSize)
 	l.buf = &b
-	l.skipHandler = config.SkipHandler
-	l.writeErrorHandler = config.WriteErrorHandler
-	l.inputRecords = make(chan part, l.maxRecordsInBuf+1)
+	l.skipHandler = skipHandlerFor(config, 0)
+	l.skipReasonHandler = config.SkipReasonHandler
+	l.skipHandlerBytes = config.SkipHandlerBytes
+	l.onBackpressure = config.OnBackpressure
+	l.samplingRate = config.SamplingRate
+	l.sampleAlways = config.SampleAlways
+	l.sampledHandler = config.SampledHandler
+	l.rotateBytes = config.RotateBytes
+	l.rotateInterval = config.RotateInterval
+	l.rotateAligned = config.RotateAligned
+	l.rotateHandler = config.RotateHandler
+	l.writeErrorHandler = writeErrorHandlerFor(config, 0)
+	l.writeErrorHandlerErr = config.WriteErrorHandlerErr
+	l.recoverHandler = config.RecoverHandler
+	l.name = config.Name
+	l.namedSkipHandler = config.NamedSkipHandler
+	l.namedErrorHandler = config.NamedWriteErrorHandler
+	l.reopenHandler = config.ReopenHandler
+	l.postWriteHandler = config.PostWriteHandler
+	l.retryCount = config.RetryCount
+	l.retryDelay = config.RetryDelay
+	l.writeTimeout = config.WriteTimeout
+	l.syncInterval = config.SyncInterval
+	l.syncBytes = config.SyncBytes
+	l.resetBlocksWrites = config.ResetBlocksWrites
+	l.flushRecordCount = config.FlushRecordCount
+	l.headerFunc = config.HeaderFunc
+	l.boundaryFlushOnly = config.BoundaryFlushOnly
+	l.lineBuffered = config.LineBuffered
+	l.maxLineDelay = config.MaxLineDelay
+	if l.maxLineDelay <= 0 {
+		l.maxLineDelay = defaultMaxLineDelay
+	}
+	l.immediateFlush = config.ImmediateFlush
+	l.adaptiveFlush = config.AdaptiveFlush
+	if l.immediateFlush {
+		// write every part as soon as it is received
+		l.chunkSize = 1
+	}
+	if !l.immediateFlush && !config.AtomicRecords {
+		l.outBufferSize = config.OutBufferSize
+	}
+	if config.AtomicRecords {
+		// flush every record as soon as it is complete
+		l.boundaryFlushOnly = true
+		l.chunkSize = 1
+	}
+	l.lineEnding = config.LineEnding
+	l.recordPrefix = bytes.Clone(config.RecordPrefix)
+	l.recordSuffix = bytes.Clone(config.RecordSuffix)
+	l.timestampFormat = config.TimestampFormat
+	l.encoder = config.Encoder
+	l.deferFlushWhileBusy = config.DeferFlushWhileBusy
+	l.flushOnIdle = config.FlushOnIdle
+	l.flushSignal = config.FlushSignal
+	l.flushOnEmptyWrite = config.FlushOnEmptyWrite
+	l.maxFlushChunkSize = config.MaxFlushChunkSize
+	l.internalLogger = config.InternalLogger
+	l.overflowPolicy = config.OverflowPolicy
+	l.reportErrors = config.ReportErrors
+	l.writeLargeRecords = config.WriteLargeRecords
+	l.maxRecordSize = config.MaxRecordSize
+	l.oversizeHandler = config.OversizeHandler
+	l.overflowWriter = config.OverflowWriter
+	l.clock = config.clock
+	if l.clock == nil {
+		l.clock = realClock{}
+	}
+	l.breaker.threshold = config.CircuitThreshold
+	l.healthWindow = config.HealthWindow
+	if l.healthWindow <= 0 {
+		l.healthWindow = defaultHealthWindow
+	}
+	if config.StallTimeout > 0 && config.StallHandler != nil {
+		l.stallTimeout = config.StallTimeout
+		l.stallHandler = config.StallHandler
+		l.progress.Store(l.clock.Now().UnixNano())
+	}
+	l.breaker.cooldown = config.CircuitCooldown
+	if l.breaker.cooldown <= 0 {
+		l.breaker.cooldown = defaultCircuitCooldown
+	}
+	l.channelCapacity = config.ChannelCapacity
+	if l.channelCapacity > 0 && l.channelCapacity < 3 {
+		// room for a record of two parts and a control part
+		l.channelCapacity = 3
+	}
+	l.inputRecords = make(chan part, l.capacity())
 	l.muInput = sync.Mutex{}
 	l.muInternal = sync.Mutex{}
-	l.ioInfo = make(chan struct{}, 2)
-	go l.ioHandler(l.buf, l.out)
-	return l
+	l.spaceFreed = sync.NewCond(&l.muInternal)
+	l.done = make(chan struct{})
+	go l.ioHandler(l.buf, l.out, l.inputRecords, l.flashPeriod)
+
+	if l.stallHandler != nil {
+		go l.watchdog()
+	}
+
+	if len(config.RotateAt) > 0 && config.RotateFilenameFunc != nil {
+		r := &rotator{l: l,
+			times:    mustParseTimesOfDay(config.RotateAt),
+			filename: config.RotateFilenameFunc,
+			clock:    l.clock}
+		go r.run()
+	}
+
+	l.sinks = newSinks(config)
+	l.config = config
+
+	if config.ExpvarPrefix != "" {
+		want := config.ExpvarPrefix
+		if config.Name != "" {
+			want += "." + config.Name
+		}
+		if prefix := l.publishExpvar(want); prefix != want {
+			l.warn(fmt.Sprintf("logwriter: expvar prefix %q is taken, using %q", want, prefix))
+		}
+	}
+	return l, nil
+}
+
+// validate checks the config for NewWithError.
+func (c *LogConfig) validate() error {
+	if c.Out == nil {
+		return fmt.Errorf("%w: Out is nil", ErrInvalidConfig)
+	}
+	for i, out := range c.Outs {
+		if out == nil {
+			return fmt.Errorf("%w: Outs[%d] is nil", ErrInvalidConfig, i)
+		}
+	}
+	switch {
+	case c.MaxBufSize < 0:
+		return fmt.Errorf("%w: MaxBufSize is negative (%d)", ErrInvalidConfig, c.MaxBufSize)
+	case c.InitialBufSize < 0:
+		return fmt.Errorf("%w: InitialBufSize is negative (%d)", ErrInvalidConfig, c.InitialBufSize)
+	case c.MaxRecordsInBuf < 0:
+		return fmt.Errorf("%w: MaxRecordsInBuf is negative (%d)", ErrInvalidConfig, c.MaxRecordsInBuf)
+	case c.ChannelCapacity < 0:
+		return fmt.Errorf("%w: ChannelCapacity is negative (%d)", ErrInvalidConfig, c.ChannelCapacity)
+	case c.FlashPeriod < 0:
+		return fmt.Errorf("%w: FlashPeriod is negative (%v)", ErrInvalidConfig, c.FlashPeriod)
+	case c.FlushRecordCount < 0:
+		return fmt.Errorf("%w: FlushRecordCount is negative (%d)", ErrInvalidConfig, c.FlushRecordCount)
+	case c.FlushJitter < 0 || c.FlushJitter >= 1:
+		return fmt.Errorf("%w: FlushJitter is not in [0, 1) (%v)", ErrInvalidConfig, c.FlushJitter)
+	case c.StallTimeout < 0:
+		return fmt.Errorf("%w: StallTimeout is negative (%v)", ErrInvalidConfig, c.StallTimeout)
+	case c.MaxRecordSize < 0:
+		return fmt.Errorf("%w: MaxRecordSize is negative (%d)", ErrInvalidConfig, c.MaxRecordSize)
+	case c.SyncInterval < 0:
+		return fmt.Errorf("%w: SyncInterval is negative (%v)", ErrInvalidConfig, c.SyncInterval)
+	case c.SyncBytes < 0:
+		return fmt.Errorf("%w: SyncBytes is negative (%d)", ErrInvalidConfig, c.SyncBytes)
+	}
+	if _, err := parseTimesOfDay(c.RotateAt); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return nil
+}
+
+// Config returns the configuration the LogWriter works with: the LogConfig passed to New with the defaults applied
+// and the values adjusted by New (for example ChunkSize lowered to MaxBufSize), so it can be logged at startup.
+// Out, MaxBufSize, MaxRecordsInBuf and FlashPeriod are the current ones, as changed by Reset, ResetConfig, SwapOutput,
+// rotations, SetMaxBufSize and SetMaxRecordsInBuf. The slices are copies; the handlers are the ones passed to New.
+func (l *LogWriter) Config() LogConfig {
+	c := l.config
+	c.Outs = slices.Clone(c.Outs)
+	c.RotateAt = slices.Clone(c.RotateAt)
+	c.RecordPrefix = bytes.Clone(l.recordPrefix)
+	c.RecordSuffix = bytes.Clone(l.recordSuffix)
+	c.ChunkSize = l.chunkSize
+	c.ChannelCapacity = l.channelCapacity
+	c.BoundaryFlushOnly = l.boundaryFlushOnly
+	c.MaxLineDelay = l.maxLineDelay
+	c.CircuitCooldown = l.breaker.cooldown
+	c.HealthWindow = l.healthWindow
+	c.OutBufferSize = l.outBufferSize
+
+	l.muInternal.Lock()
+	defer l.muInternal.Unlock()
+	c.Out = l.out
+	c.MaxBufSize = l.bufLimit()
+	if l.growTo == 0 {
+		c.InitialBufSize = 0
+	}
+	c.MaxRecordsInBuf = l.maxRecordsInBuf
+	c.FlashPeriod = l.flashPeriod
+	return c
 }
 
 // Reset sets a new destination for LogWriter.
 // Reset returns control only when all records in old Out are written.
 // After returning from the Reset old Out can be closed.
+//
+// Reset switches to a new buffer and the new Out at once, so records written after the switch go to the new Out.
+// Every record lands in exactly one Out, once: a Write that has already taken space in the old buffer when the switch happens,
+// but has not yet queued it, has its record written to the old Out, and Reset waits for it as well.
+// So the record of a Write that overlaps with Reset may be in either Out; with ResetBlocksWrites set,
+// Reset waits for such writes to finish and blocks new ones until the switch is queued, so the switch is a clean cut
+// between the records written before and after it. Writes are not blocked while the old Out is drained.
+// Reset may be called from several goroutines at once: the switches happen one after another,
+// and each call waits for the Out it replaced, not for the others.
+// Reset does nothing after Close.
 func (l *LogWriter) Reset(out io.Writer) {
-	l.reset(out)
+	l.ResetContext(context.Background(), out)
+}
+
+// ResetContext is like Reset, but stops waiting for the old Out when ctx is done and returns ctx.Err().
+// The switch to the new Out has happened by then anyway: the old buffer keeps being written to the old Out in the background,
+// and records written after the switch go to the new Out once it is done. The old Out must not be closed before that.
+// After Close, ResetContext returns ErrClosed.
+func (l *LogWriter) ResetContext(ctx context.Context, out io.Writer) error {
+	if !l.resetOut(out) {
+		return ErrClosed
+	}
+	drained := l.retired()
+
 	// wait to write all records to old io.Writer
-	<-l.ioInfo
+	select {
+	case <-drained:
+		l.resetLeft.Store(false)
+		return nil
+	case <-ctx.Done():
+		l.resetLeft.Store(true)
+		return ctx.Err()
+	}
+}
+
+// LastResetDrained reports whether the most recent Reset, ResetContext, ResetAndFlush or ResetConfig to return
+// had all records of the old Out written before it returned, so the old Out is complete and may be closed or archived.
+// It is false after ResetContext has returned because ctx was done: the old Out may still be being written then.
+// It is true if no reset has happened.
+func (l *LogWriter) LastResetDrained() bool {
+	return !l.resetLeft.Load()
+}
+
+// ResetAndFlush is like Reset, but also returns the number of bytes written successfully to the old Out while it was Out,
+// from the time it was set by New, Reset, SwapOutput or a rotation, including its records written during the switch.
+// The bytes of a failed write and of the HeaderFunc header are not counted, so after a successful run the count matches
+// the records that were given to the old Out. If Reset or ResetAndFlush is called from other goroutines at the same time,
+// the count covers the Outs replaced by them too. After Close, ResetAndFlush returns ErrClosed.
+func (l *LogWriter) ResetAndFlush(out io.Writer) (bytesFlushed int, err error) {
+	if !l.resetOut(out) {
+		return 0, ErrClosed
+	}
+	meta := &partMeta{drained: make(chan struct{})}
+	if err := l.sendControl(meta); err != nil {
+		// closed meanwhile: Close has written everything, but the count is lost
+		return 0, err
+	}
+	<-meta.drained
+	l.resetLeft.Store(false)
+	return meta.flushed, nil
+}
+
+// resetOut switches to a new buffer and out for Reset, holding off writes if ResetBlocksWrites is set.
+// It returns false after Close.
+func (l *LogWriter) resetOut(out io.Writer) bool {
+	var ok bool
+	if l.resetBlocksWrites {
+		l.muInput.Lock()
+		ok = l.reset(out, 0, 0)
+		l.muInput.Unlock()
+	} else {
+		ok = l.reset(out, 0, 0)
+	}
+	if ok {
+		l.notifyBackpressure()
+	}
+	return ok
+}
+
+// ResetConfig is like Reset, but installs the tunables of config together with its Out, for example on a config reload:
+// the new Out, MaxBufSize, MaxRecordsInBuf and FlashPeriod all apply from the same point, the first record after the switch.
+// Zero values mean the defaults, as with New. A new buffer is allocated even if MaxBufSize stays the same.
+// The records buffered before the switch are written to the old Out with the old settings, and ResetConfig returns
+// when they are written; writes are paused briefly while the new buffer is installed, as with SetMaxBufSize.
+// The other fields of config are ignored: ChannelCapacity, Outs, the handlers, rotation, formatting and the rest
+// are fixed by New and need a new LogWriter to change. Out must not be nil.
+// ResetConfig returns an error wrapping ErrInvalidConfig for an invalid config, or ErrClosed after Close.
+func (l *LogWriter) ResetConfig(config LogConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	size := config.MaxBufSize
+	if size == 0 {
+		size = defaultMaxBufSize
+	} else if size < 2 {
+		return fmt.Errorf("%w: MaxBufSize must be at least 2 (%d)", ErrInvalidConfig, size)
+	}
+	records := config.MaxRecordsInBuf
+	if records == 0 {
+		records = defaultMaxRecordsInBuf
+	}
+	period := config.FlashPeriod
+	if period == 0 {
+		period = defaultFlashPeriod
+	} else if period < minFlashPeriod {
+		period = minFlashPeriod
+	}
+
+	l.muInput.Lock()
+	l.muInternal.Lock()
+	if l.closed {
+		l.muInternal.Unlock()
+		l.muInput.Unlock()
+		return ErrClosed
+	}
+	var old chan part
+	var q []part
+	if records != l.maxRecordsInBuf {
+		old, q = l.setMaxRecordsInBuf(records)
+	}
+	l.muInternal.Unlock()
+	for _, p := range q {
+		old <- p
+	}
+	// Close waits for muInput, so the LogWriter is still open
+	l.reset(config.Out, size, period)
+	l.muInput.Unlock()
+
+	l.notifyBackpressure()
+	<-l.retired()
+	l.resetLeft.Store(false)
+	return nil
 }
 
-func (l *LogWriter) reset(out io.Writer) {
+// reset switches to a new buffer and out. It returns false after Close.
+// If size is positive, the new buffer has size bytes (SetMaxBufSize); if out is nil, Out stays the same;
+// if period is positive, it is the new FlashPeriod (ResetConfig).
+// The old buffer is written to the old Out in the background; wait for retired to know when it is done.
+func (l *LogWriter) reset(out io.Writer, size int, period time.Duration) bool {
 	l.muInternal.Lock()
 	defer l.muInternal.Unlock()
 
+	if l.closed {
+		return false
+	}
+
+	if size > 0 {
+		l.maxBufSize = size
+		// the size is fixed from now on
+		l.growTo = 0
+	}
+	if out != nil {
+		l.out = out
+	}
+	if period > 0 {
+		l.flashPeriod = period
+	}
+	l.switchBuffer(&partMeta{fresh: true, period: period})
+	return true
+}
+
+// grow replaces the buffer with a larger one for a record of lenP bytes that does not fit (InitialBufSize):
+// twice as large, or enough for the record, up to MaxBufSize. It must be called under muInput and muInternal,
+// so no write holds space in the old buffer; ioHandler writes the old buffer to Out before it takes the new one.
+func (l *LogWriter) grow(lenP int) {
+	l.maxBufSize = min(l.growTo, max(2*l.maxBufSize, lenP+1))
+	l.switchBuffer(&partMeta{fresh: true, grown: true})
+}
+
+// growable reports whether allocMem can replace the buffer with a larger one. It must be called under muInternal.
+// The part that moves ioHandler to the new buffer and the record need a slot each, besides the one kept for Reset.
+func (l *LogWriter) growable() bool {
+	return l.maxBufSize < l.growTo && l.queuedLen()+2 < cap(l.inputRecords)
+}
+
+// bufLimit returns the size the buffer can have: MaxBufSize, or the current size after SetMaxBufSize.
+// It must be called under muInput or muInternal.
+func (l *LogWriter) bufLimit() int {
+	return max(l.maxBufSize, l.growTo)
+}
+
+// switchBuffer installs an empty buffer of maxBufSize bytes and queues the part meta that moves ioHandler to it.
+// It must be called under muInternal; the part is sent by the next sender, see sendQueued.
+func (l *LogWriter) switchBuffer(meta *partMeta) {
 	b := make([]byte, l.maxBufSize)
 	l.buf = &b
 	l.startPos = 0
 	l.endPos = 0
-	l.out = out
 	l.skipping = false
+	l.spaceFreed.Broadcast()
 
 	// write special null part for detect reopen log file
 	var newpart part
 	newpart.setPart(l.buf, 0, 0, l.out)
-	l.inputRecords <- newpart
+	newpart.meta = meta
+	l.queued = append(l.queued, newpart)
 }
 
-// Write appends the contents of p to the circular buffer.
-// The return value n is the length of p; err is always nil.
-func (l *LogWriter) Write(p []byte) (n int, err error) {
-	lenP := len(p)
-	if lenP < 1 {
-		return 0, nil
+// takeQueued returns the queued parts, which the caller sends before any part it has reserved with them.
+// It must be called under muInput and muInternal.
+func (l *LogWriter) takeQueued() []part {
+	q := l.queued
+	l.queued = nil
+	return q
+}
+
+// sendQueued sends the queued parts. It must be called under muInput, but not under muInternal:
+// if the channel is full, it waits for ioHandler, which may need muInternal to get there.
+func (l *LogWriter) sendQueued() {
+	l.muInternal.Lock()
+	q := l.takeQueued()
+	l.muInternal.Unlock()
+	l.send(q)
+}
+
+// send sends parts to ioHandler in order. It must be called under muInput, but not under muInternal.
+func (l *LogWriter) send(parts []part) {
+	for _, p := range parts {
+		l.inputRecords <- p
 	}
+}
 
-	l.muInput.Lock()
-	defer l.muInput.Unlock()
+// queuedLen returns the number of parts waiting for ioHandler. It must be called under muInternal.
+func (l *LogWriter) queuedLen() int {
+	return len(l.inputRecords) + len(l.queued)
+}
 
-	buffers, count := l.allocMem(lenP)
+// retired queues a part after the writes that have taken space in the buffers replaced by reset so far
+// and returns a channel closed when ioHandler reaches it: by then the old Outs have got all their records.
+// It must not be called under muInput, as it waits for these writes to be queued.
+func (l *LogWriter) retired() chan struct{} {
+	drained := make(chan struct{})
+	if l.sendControl(&partMeta{drained: drained}) != nil {
+		// closed meanwhile: Close has written everything
+		close(drained)
+	}
+	return drained
+}
 
-	if count == 0 {
-		// always return "ok"
-		if l.skipHandler != nil {
-			l.skipHandler(1)
+// Close writes everything buffered to Out, including the records still queued, and stops the background goroutine.
+// After Close, Write returns ErrClosed and Reset does nothing. Out itself is not closed.
+// Close may be called more than once and concurrently with Write; every call returns once the LogWriter is stopped,
+// the first one with the error of the last write to Out. The buffer is released, so a closed LogWriter holds no memory for records.
+// The LogWriters of Outs are closed too.
+func (l *LogWriter) Close() error {
+	for _, s := range l.sinks {
+		s.Close()
+	}
+	err := l.queueControl(&partMeta{done: make(chan error, 1), stop: true})
+	<-l.done
+	if err == ErrClosed {
+		return nil
+	}
+	l.release()
+	return err
+}
+
+// release drops the buffer and the expvar counters of a stopped LogWriter.
+func (l *LogWriter) release() {
+	l.muInternal.Lock()
+	l.buf = nil
+	l.muInternal.Unlock()
+	l.unpublishExpvar()
+}
+
+// CloseWithTimeout is like Close, but gives up writing the buffered records to Out after d
+// and returns ErrCloseTimeout, for example to bound the time of a graceful shutdown. The unwritten records are lost.
+// The background goroutine writes nothing more and stops as soon as the write to Out in progress returns;
+// if that write hangs forever, the goroutine stays blocked in it, as no code can stop it from outside.
+// The Outs are closed with the same deadline. A nil result means the background goroutines have stopped.
+func (l *LogWriter) CloseWithTimeout(d time.Duration) error {
+	timeout := l.clock.After(d)
+	writers := append([]*LogWriter{l}, l.sinks...)
+	stops := make([]*partMeta, len(writers))
+	for i, w := range writers {
+		// queue the stop without waiting for it; the last slot of the channel is kept for such parts
+		stops[i] = &partMeta{done: make(chan error, 1), stop: true}
+		if w.sendControl(stops[i]) != nil {
+			stops[i] = nil
+		}
+	}
+	for _, w := range writers {
+		select {
+		case <-w.done:
+		case <-timeout:
+			l.abandon()
+			l.unpublishExpvar()
+			return ErrCloseTimeout
+		}
+	}
+	for i, w := range writers {
+		if stops[i] != nil {
+			w.release()
 		}
-		return lenP, nil
 	}
+	if stops[0] == nil {
+		return nil
+	}
+	// answered before done was closed
+	return <-stops[0].done
+}
 
-	for i := 0; i < count; i++ {
-		b := &buffers[i]
-		copy((*b.pBuf)[b.sPos:b.ePos], p[:b.ePos-b.sPos])
-		l.inputRecords <- buffers[i]
-		p = p[b.ePos-b.sPos:]
+// abandon makes the LogWriter and its sinks drop everything that is not written yet instead of writing it.
+func (l *LogWriter) abandon() {
+	for _, s := range l.sinks {
+		s.abandon()
 	}
+	l.abandoned.Store(true)
+}
 
-	return lenP, nil
+// Flush writes everything buffered so far to Out and to the Outs, and returns when all of them have got it,
+// with the error of the last write to Out joined with those of the Outs, or ErrClosed after Close.
+// It does not wait for FlashPeriod and returns at once if there is nothing to write.
+// Unlike Reset, Flush keeps the buffer and Out; when it returns, the background write is over and Out has the data,
+// so a file can be synced right after it. A write given up after WriteTimeout is reported as ErrWriteTimeout instead.
+func (l *LogWriter) Flush() error {
+	err := l.queueControl(&partMeta{done: make(chan error, 1)})
+	if err == ErrClosed || len(l.sinks) == 0 {
+		return err
+	}
+	errs := make([]error, 0, len(l.sinks)+1)
+	errs = append(errs, err)
+	for _, s := range l.sinks {
+		errs = append(errs, s.Flush())
+	}
+	return errors.Join(errs...)
 }
 
-func (l *LogWriter) allocMem(lenP int) (freeSlice [2]part, n int) {
-	var freeBytes int
+// FlushAndWait is Flush: it queues an empty part after the records and waits for the background goroutines
+// to write them and reach the part, so the buffer and Out stay as they are, unlike with Reset.
+func (l *LogWriter) FlushAndWait() error {
+	return l.Flush()
+}
 
-	l.muInternal.Lock()
-	defer l.muInternal.Unlock()
+// Truncate writes everything buffered so far to Out, like Flush, and then starts the buffer over at its beginning,
+// reusing it instead of allocating a new one as Reset and SetMaxBufSize do, for example to reuse a pooled LogWriter.
+// Out stays the same. The bulk of the buffer is written while writes go on as usual;
+// they wait only while the records written meanwhile are written too, so no stale data of the old region is ever written.
+// Truncate returns the error of the last write, or ErrClosed after Close. The LogWriters of Outs are truncated too.
+// Handlers called by the background goroutine, such as PostWriteHandler, must not write to the LogWriter during Truncate.
+func (l *LogWriter) Truncate() error {
+	for _, s := range l.sinks {
+		s.Truncate()
+	}
+	if err := l.queueControl(&partMeta{done: make(chan error, 1)}); err != nil {
+		return err
+	}
 
-	if l.skipping == true {
-		return
+	// no write may take space while ioHandler moves to the beginning of the buffer
+	l.muInput.Lock()
+	defer l.muInput.Unlock()
+	meta := &partMeta{done: make(chan error, 1), rewind: true}
+	if err := l.sendControlLocked(meta); err != nil {
+		return err
 	}
+	return <-meta.done
+}
 
-	freeBytes = l.freeSize()
+// queueControl queues an empty part carrying meta after everything buffered so far
+// and waits until ioHandler has processed it.
+func (l *LogWriter) queueControl(meta *partMeta) error {
+	if err := l.sendControl(meta); err != nil {
+		return err
+	}
+	return <-meta.done
+}
 
-	if freeBytes >= lenP && len(l.inputRecords) < l.maxRecordsInBuf {
-		oldEnd := l.endPos
-		l.endPos = (l.endPos + lenP) % l.maxBufSize
-
-		if oldEnd < l.endPos {
-			//freeSlice[0] = l.buf[oldEnd:l.endPos]
-			freeSlice[0].setPart(l.buf, oldEnd, l.endPos, l.out)
-			n = 1
-		} else {
-			//freeSlice[0] = l.buf[oldEnd:]
-			freeSlice[0].setPart(l.buf, oldEnd, len(*l.buf), l.out)
-			n = 1
-			if l.endPos > 0 {
-				//freeSlice[1] = l.buf[:l.endPos]
-				freeSlice[1].setPart(l.buf, 0, l.endPos, l.out)
-				n = 2
-			}
+// flushAsync asks ioHandler to write everything buffered so far, like Flush, but does not wait for it.
+func (l *LogWriter) flushAsync() {
+	for _, s := range l.sinks {
+		s.flushAsync()
+	}
+	// done is buffered, ioHandler does not block on the answer nobody reads
+	l.sendControl(&partMeta{done: make(chan error, 1)})
+}
+
+// sendControl queues an empty part carrying meta after everything buffered so far.
+func (l *LogWriter) sendControl(meta *partMeta) error {
+	l.muInput.Lock()
+	defer l.muInput.Unlock()
+	return l.sendControlLocked(meta)
+}
+
+// sendControlLocked is sendControl for a caller that holds muInput.
+func (l *LogWriter) sendControlLocked(meta *partMeta) error {
+	l.muInternal.Lock()
+	if l.closed {
+		l.muInternal.Unlock()
+		return ErrClosed
+	}
+	if meta.out != nil {
+		l.out = meta.out
+	}
+	if meta.stop {
+		l.closed = true
+		l.spaceFreed.Broadcast()
+	}
+	var p part
+	p.setPart(l.buf, l.endPos, l.endPos, l.out)
+	p.meta = meta
+	q := l.takeQueued()
+	l.muInternal.Unlock()
+	l.send(append(q, p))
+	return nil
+}
+
+// Write appends the contents of p to the circular buffer.
+// The return value n is the length of p; err is nil, or ErrClosed after Close.
+// An empty p is a no-op, or, with FlushOnEmptyWrite, a request to write the buffer to Out without waiting for it.
+func (l *LogWriter) Write(p []byte) (n int, err error) {
+	lenP := len(p)
+	if lenP < 1 {
+		if l.flushOnEmptyWrite {
+			l.flushAsync()
 		}
-	} else {
-		l.skipping = true
+		return 0, nil
 	}
-	return
+	if l.oversize(lenP) {
+		return 0, ErrRecordOversize
+	}
+
+	return l.result(lenP, l.store(l.normalize(p), nil))
 }
 
-func (l *LogWriter) freeSize() int {
-	if l.startPos <= l.endPos {
-		return l.maxBufSize - (l.endPos - l.startPos) - 1
+// WriteString is like Write, but takes a string, so the caller does not need to convert it to a byte slice.
+// Unless Encoder or SkipHandlerBytes is set, the string is copied to the buffer directly, without an intermediate allocation.
+func (l *LogWriter) WriteString(s string) (n int, err error) {
+	if l.encoder != nil || l.skipHandlerBytes != nil {
+		// they get the record as a byte slice they may keep or modify, which must not be the memory of the string
+		return l.Write([]byte(s))
 	}
+	// Write only reads p, so it is safe to give it the bytes of the string
+	return l.Write(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
 
-	return l.startPos - l.endPos - 1
+// result converts the error of store to the result of Write: ErrClosed is always returned,
+// ErrDropped only if ReportErrors is set, so by default Write returns "ok" for a skipped record.
+func (l *LogWriter) result(n int, err error) (int, error) {
+	if err == ErrClosed || err == ErrRecordTooLarge || (err == ErrDropped && l.reportErrors) {
+		return 0, err
+	}
+	return n, nil
 }
 
-func (l *LogWriter) ioHandler(cBuf *[]byte, out io.Writer) {
-	var s, e int
-	ticker := time.NewTicker(l.flashPeriod)
-	defer ticker.Stop()
+// maxReadChunk is the largest chunk ReadFrom reads at once.
+const maxReadChunk = 32 * 1024
+
+// ReadFrom implements io.ReaderFrom, so io.Copy to a LogWriter reads r in chunks of up to 32 KB (less for a smaller buffer)
+// with a single intermediate slice, for example to pump the output of another process into the log.
+// The stream has no record boundaries, so it is cut into records at line ends: a partial line waits for its end
+// until the chunk is full or r ends, and lines of other writers do not get into the middle of its lines.
+// The records are written as they are, without LineEnding, Encoder, TimestampFormat, RecordPrefix and RecordSuffix.
+// When a record is skipped, ReadFrom stops and returns ErrDropped (whatever ReportErrors is); with OverflowBlock it waits instead.
+// n is the number of bytes read from r, including those of the skipped record.
+func (l *LogWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	l.muInternal.Lock()
+	size := min(maxReadChunk, l.maxBufSize-1)
+	l.muInternal.Unlock()
 
+	buf := make([]byte, size)
+	// held is the length of the partial line at the start of buf
+	held := 0
 	for {
-		select {
-		case <-ticker.C:
-			if s < e {
-				l.write((*cBuf)[s:e], out)
-				l.freeMem(cBuf, e-s)
-				s = e
-			}
-		case p := <-l.inputRecords:
-			if p.pBuf != cBuf {
-				if s < e {
-					l.write((*cBuf)[s:e], out)
-				}
-				l.ioInfo <- struct{}{}
-				cBuf = p.pBuf
-				out = p.out
-				s = p.sPos
-				e = p.sPos
-			}
+		c, rerr := r.Read(buf[held:])
+		n += int64(c)
+		held += c
 
-			if e != p.sPos {
-				l.write((*cBuf)[s:e], out)
-				l.freeMem(cBuf, e-s)
-				s = p.sPos
-				e = p.sPos
+		end := held
+		if rerr == nil && held < len(buf) {
+			end = bytes.LastIndexByte(buf[:held], '\n') + 1
+		}
+		if end > 0 {
+			if err = l.store(record{2: buf[:end]}, nil); err != nil {
+				return n, err
 			}
+			held = copy(buf, buf[end:held])
+		}
 
-			if p.ePos-s < 4096 {
-				e = p.ePos
-			} else {
-				l.write((*cBuf)[s:p.ePos], out)
-				l.freeMem(cBuf, p.ePos-s)
-				s = p.ePos
-				e = p.ePos
-			}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
 		}
 	}
 }
 
-func (l *LogWriter) freeMem(cBuf *[]byte, lenP int) {
-	l.muInternal.Lock()
-	defer l.muInternal.Unlock()
-	if cBuf != l.buf {
-		return
+// TryWrite is like Write, but never waits: if another goroutine is writing to the buffer at the moment,
+// the record is skipped and reported to SkipHandler like a record that does not fit (with the reason SkippedBusy).
+// It does not wait for space with OverflowBlock either. It returns whether the record was buffered.
+// TryWrite is meant for goroutines that must not stall, where losing a record is better than waiting for a lock.
+func (l *LogWriter) TryWrite(p []byte) (ok bool) {
+	if len(p) < 1 {
+		return true
 	}
-	l.startPos = (l.startPos + lenP) % l.maxBufSize
-	if l.skipping == true && l.freeSize() >= (l.maxBufSize/2) && len(l.inputRecords) < (l.maxRecordsInBuf/2) {
-		l.skipping = false
+	if l.oversize(len(p)) {
+		return false
 	}
+
+	rec := l.normalize(p)
+	l.fanOut(rec, true)
+	return l.buffer(rec, nil, true) == nil
 }
 
-func (l *LogWriter) write(p []byte, out io.Writer) {
-	defer func() {
-		if p := recover(); p != nil {
-			if l.writeErrorHandler != nil {
-				l.writeErrorHandler(out)
-			}
+// WriteAndWait appends the contents of p to the circular buffer and blocks until the record is written to Out.
+// It returns the error of the write that contained the record, or ErrDropped if the record was skipped.
+// The record and everything buffered before it are written at once, without waiting for batching,
+// so WriteAndWait costs a write to Out per call and should be reserved for records that must be confirmed.
+func (l *LogWriter) WriteAndWait(p []byte) error {
+	if len(p) < 1 {
+		return nil
+	}
+	if l.oversize(len(p)) {
+		return ErrRecordOversize
+	}
+
+	meta := &partMeta{done: make(chan error, 1)}
+	if err := l.store(l.normalize(p), meta); err != nil {
+		return err
+	}
+	return <-meta.done
+}
+
+// store buffers a record according to OverflowPolicy.
+func (l *LogWriter) store(rec record, meta *partMeta) error {
+	return l.storeContext(context.Background(), rec, meta, l.overflowPolicy == OverflowBlock)
+}
+
+// storeContext is store that, if block is set, waits for free space instead of following OverflowPolicy, until ctx is done.
+func (l *LogWriter) storeContext(ctx context.Context, rec record, meta *partMeta, block bool) error {
+	l.fanOut(rec, false)
+	if block {
+		return l.bufferBlocking(ctx, rec, meta)
+	}
+	return l.buffer(rec, meta, false)
+}
+
+// normalize makes a record of p: it normalizes the line ending according to LineEnding, encodes the payload with Encoder,
+// stamps the record according to TimestampFormat and frames it with RecordPrefix and RecordSuffix.
+func (l *LogWriter) normalize(p []byte) record {
+	body, ending := p, []byte(nil)
+	if l.lineEnding != LineEndingKeep {
+		body = bytes.TrimSuffix(p, []byte("\n"))
+		if len(body) < len(p) {
+			body = bytes.TrimSuffix(body, []byte("\r"))
 		}
-	}()
+		ending = lineEndings[l.lineEnding]
+	}
+	if l.encoder != nil {
+		body = l.encoder.Encode(nil, body)
+	}
+	return record{l.recordPrefix, l.timestamp(), body, ending, l.recordSuffix}
+}
 
-	_, err := out.Write(p)
-	if err != nil {
-		if l.writeErrorHandler != nil {
-			l.writeErrorHandler(out)
+// timestamp returns the current time formatted according to TimestampFormat and a space, or nil if it is not set.
+func (l *LogWriter) timestamp() []byte {
+	if l.timestampFormat == "" {
+		return nil
+	}
+
+	now := l.clock.Now()
+	b := make([]byte, 0, 40)
+	if l.timestampFormat == TimestampUnixNano {
+		b = strconv.AppendInt(b, now.UnixNano(), 10)
+	} else {
+		b = now.AppendFormat(b, l.timestampFormat)
+	}
+	return append(b, ' ')
+}
+
+// buffer copies the record to the circular buffer and queues it for ioHandler.
+// meta is attached to the record and may be nil.
+// If try is set and muInput is held by another writer, the record is skipped instead of waiting for it.
+// buffer returns ErrDropped or ErrRecordTooLarge if the record is skipped, or ErrClosed.
+func (l *LogWriter) buffer(rec record, meta *partMeta, try bool) error {
+	lenP := rec.len()
+	if lenP < 1 {
+		if meta != nil && meta.done != nil {
+			meta.done <- nil
+		}
+		return nil
+	}
+
+	if !try {
+		l.muInput.Lock()
+	} else if !l.muInput.TryLock() {
+		l.skipped(1, SkippedBusy)
+		l.skippedRecord(rec)
+		return ErrDropped
+	}
+	if l.closed {
+		l.muInput.Unlock()
+		return ErrClosed
+	}
+	// maxBufSize changes only under muInput
+	size := l.bufLimit()
+	started, err := l.bufferLocked(rec, meta)
+	l.muInput.Unlock()
+	if started {
+		l.skippingStarted()
+	}
+	if err == errSpill {
+		return l.spill(rec, meta)
+	}
+	if err == errSampled {
+		return ErrDropped
+	}
+	if err == ErrRecordTooLarge {
+		l.tooLarge(lenP, size)
+	}
+	return err
+}
+
+// bufferLocked is the part of buffer done under muInput, for a record that is not empty.
+// It reports whether skipping has just been turned on (see skippingStarted) and returns nil if the record was queued,
+// ErrDropped or ErrRecordTooLarge if it was skipped, errSampled if it was sampled out, or errSpill if it is to be passed to spill.
+func (l *LogWriter) bufferLocked(rec record, meta *partMeta) (started bool, err error) {
+	lenP := rec.len()
+	limit := l.bufLimit()
+	if lenP > limit-1 && l.writeLargeRecords && l.queueDirect(rec, meta, false) {
+		return false, nil
+	}
+	if lenP > limit-1 && l.writeLargeRecords && l.overflowWriter == nil {
+		// the channel is full: the record is skipped like one that does not fit into the buffer now
+		l.skipped(1, SkippedNewest)
+		l.skippedRecord(rec)
+		return false, ErrDropped
+	}
+	if lenP > limit-1 && l.overflowWriter != nil {
+		return false, errSpill
+	}
+	if lenP > limit-1 {
+		// do not turn on skipping, the records after it may fit
+		l.skipped(1, SkippedTooLarge)
+		l.skippedRecord(rec)
+		return false, ErrRecordTooLarge
+	}
+
+	// a record kept by sampling is tried even while skipping is on
+	sampled := false
+	if l.samplingRate > 1 {
+		var keep bool
+		if sampled, keep = l.sample(); !keep {
+			return false, errSampled
+		}
+	}
+
+	buffers, count, queued, started := l.allocMem(lenP, l.overflowPolicy == OverflowDropOldest || sampled)
+
+	if count == 0 && l.overflowPolicy == OverflowDropOldest {
+		if dropped, lost := l.dropOldest(lenP); dropped > 0 {
+			l.skipped(dropped, DroppedOldest)
+			for _, b := range lost {
+				l.skipHandlerBytes(b)
+			}
+			buffers, count, queued, _ = l.allocMem(lenP, true)
+		}
+		if count == 0 {
+			// the records taken out of the channel by dropOldest are queued again
+			l.sendQueued()
+		}
+	}
+
+	if count == 0 && l.overflowWriter != nil {
+		return started, errSpill
+	}
+	if count == 0 {
+		l.skipped(1, SkippedNewest)
+		l.skippedRecord(rec)
+		return started, ErrDropped
+	}
+
+	l.enqueue(queued, buffers[:count], rec, meta)
+	return started, nil
+}
+
+// sample decides on a record if sampling is on: while skipping is on, or always with SampleAlways.
+// It reports whether the record is sampled and whether it is kept; a dropped record is reported to SampledHandler.
+// It must be called under muInput.
+func (l *LogWriter) sample() (sampled, keep bool) {
+	l.muInternal.Lock()
+	sampled = l.sampleAlways || l.skipping
+	l.muInternal.Unlock()
+	if !sampled {
+		return false, true
+	}
+
+	l.sampleCount++
+	// keep the first record of every samplingRate
+	if l.sampleCount%uint64(l.samplingRate) == 1 {
+		return true, true
+	}
+	l.metrics.sampledRecords.Add(1)
+	if l.sampledHandler != nil {
+		l.sampledHandler(1)
+	}
+	return true, false
+}
+
+// queueDirect queues a copy of a record larger than the buffer in a part of its own, after everything buffered so far.
+// If the channel has no room for the part, it returns false without queueing the record, unless block is set:
+// then it waits for ioHandler to make room. It must be called under muInput.
+func (l *LogWriter) queueDirect(rec record, meta *partMeta, block bool) bool {
+	var p part
+	l.muInternal.Lock()
+	if !block && !l.room(1) {
+		l.muInternal.Unlock()
+		return false
+	}
+	p.setPart(l.buf, l.endPos, l.endPos, l.out)
+	queued := l.takeQueued()
+	l.muInternal.Unlock()
+
+	data := make([]byte, 0, rec.len())
+	for _, piece := range rec {
+		data = append(data, piece...)
+	}
+	if meta == nil {
+		meta = &partMeta{}
+	}
+	meta.direct = data
+	p.meta = meta
+	l.send(append(queued, p))
+	l.accepted(rec)
+	return true
+}
+
+// spill writes a record that does not fit into the buffer to OverflowWriter and reports the result to meta, if it waits for it.
+// If the write fails, the record is skipped. It must not be called under muInput or muInternal.
+func (l *LogWriter) spill(rec record, meta *partMeta) error {
+	l.muSpill.Lock()
+	l.spillBuf = l.spillBuf[:0]
+	for _, piece := range rec {
+		l.spillBuf = append(l.spillBuf, piece...)
+	}
+	_, err := writeOut(l.spillBuf, l.overflowWriter)
+	l.muSpill.Unlock()
+
+	if err != nil {
+		l.skipped(1, SkippedNewest)
+		l.skippedRecord(rec)
+		l.warn(fmt.Sprintf("logwriter: can not write to OverflowWriter, record skipped: %v", err))
+		return ErrDropped
+	}
+	l.metrics.spilledRecords.Add(1)
+	if meta != nil && meta.done != nil {
+		meta.done <- nil
+	}
+	return nil
+}
+
+// oversize reports whether a record of n bytes is longer than MaxRecordSize. Such a record is counted
+// and passed to OversizeHandler, and the caller drops it.
+func (l *LogWriter) oversize(n int) bool {
+	if l.maxRecordSize <= 0 || n <= l.maxRecordSize {
+		return false
+	}
+	l.metrics.oversizeRecords.Add(1)
+	if l.oversizeHandler != nil {
+		l.oversizeHandler(n)
+	}
+	return true
+}
+
+// tooLarge reports a record of lenP bytes skipped because it is larger than the buffer of size bytes.
+// It must not be called under muInput or muInternal.
+func (l *LogWriter) tooLarge(lenP, size int) {
+	l.warn(fmt.Sprintf("logwriter: record of %d bytes does not fit into the buffer of %d bytes, skipped", lenP, size))
+}
+
+// skippingStarted reports that the buffer has become full. It must not be called under muInput or muInternal.
+func (l *LogWriter) skippingStarted() {
+	l.warn("logwriter: buffer is full, skipping records")
+	l.notifyBackpressure()
+}
+
+// WriteRecords appends each of records to the circular buffer like Write, but takes the buffer once for all of them.
+// It returns the number of records accepted: once a record does not fit, it and all the records after it are skipped
+// and reported to SkipHandler, and err is ErrDropped (ErrRecordTooLarge for a record larger than the buffer).
+// With OverflowWriter, the records that do not fit are spilled to it instead, after the others are buffered, and all are accepted.
+// Records sampled out by SamplingRate count as accepted too. Records longer than MaxRecordSize are dropped and not counted,
+// but do not stop the records after them; err is then ErrRecordOversize, unless another error is returned.
+// After Close it returns 0 and ErrClosed.
+// With OverflowBlock, WriteRecords waits for space for each record in turn, like Write.
+func (l *LogWriter) WriteRecords(records [][]byte) (written int, err error) {
+	recs := make([]record, len(records))
+	// oversize marks the records longer than MaxRecordSize, left empty in recs
+	var oversize []bool
+	for i, p := range records {
+		// empty records are accepted with nothing to write, as with Write
+		if l.oversize(len(p)) {
+			if oversize == nil {
+				oversize = make([]bool, len(records))
+			}
+			oversize[i] = true
+		} else if len(p) > 0 {
+			recs[i] = l.normalize(p)
+		}
+	}
+	if oversize != nil {
+		defer func() {
+			// the oversized records before the first one not accepted were passed over, but are not accepted either
+			for _, o := range oversize[:written] {
+				if o {
+					written--
+				}
+			}
+			if err == nil {
+				err = ErrRecordOversize
+			}
+		}()
+	}
+
+	if l.overflowPolicy == OverflowBlock {
+		for written < len(recs) {
+			if err = l.store(recs[written], nil); err != nil {
+				break
+			}
+			written++
+		}
+		if err == ErrRecordTooLarge {
+			// the record that can never fit has been reported by store
+			l.skippedRecords(recs[written+1:])
+		}
+		return written, err
+	}
+
+	for _, rec := range recs {
+		l.fanOut(rec, false)
+	}
+	l.muInput.Lock()
+	if l.closed {
+		l.muInput.Unlock()
+		return 0, ErrClosed
+	}
+	size := l.bufLimit()
+	var started bool
+	// spilled are the records that did not fit, to be written to OverflowWriter after unlocking
+	var spilled []record
+	for ; written < len(recs); written++ {
+		if recs[written].len() == 0 {
+			continue
+		}
+		var s bool
+		s, err = l.bufferLocked(recs[written], nil)
+		started = started || s
+		if err == errSpill {
+			spilled = append(spilled, recs[written])
+			err = nil
+			continue
+		}
+		if err == errSampled {
+			// dropped on purpose, the records after it are still tried
+			err = nil
+			continue
+		}
+		if err != nil {
+			l.skippedRecords(recs[written+1:])
+			break
+		}
+	}
+	l.muInput.Unlock()
+	if started {
+		l.skippingStarted()
+	}
+	for _, rec := range spilled {
+		// a record that can not be spilled is lost like a skipped one, but the others are kept
+		if l.spill(rec, nil) != nil && err == nil {
+			err = ErrDropped
+		}
+	}
+	if err == ErrRecordTooLarge {
+		l.tooLarge(recs[written].len(), size)
+	}
+	return written, err
+}
+
+// skippedRecords reports the records, given up on by WriteRecords, as skipped.
+func (l *LogWriter) skippedRecords(recs []record) {
+	n := 0
+	for _, rec := range recs {
+		if rec.len() > 0 {
+			n++
+		}
+	}
+	if n == 0 {
+		return
+	}
+	l.skipped(n, SkippedNewest)
+	for _, rec := range recs {
+		if rec.len() > 0 {
+			l.skippedRecord(rec)
+		}
+	}
+}
+
+// bufferBlocking is like buffer, but waits for free space instead of skipping the record, until ctx is done.
+// It does not hold muInput while waiting, so other writers are not blocked.
+// It returns ErrRecordTooLarge if the record can never fit into the buffer, ErrClosed, or ctx.Err().
+func (l *LogWriter) bufferBlocking(ctx context.Context, rec record, meta *partMeta) (err error) {
+	lenP := rec.len()
+	if lenP < 1 {
+		if meta != nil && meta.done != nil {
+			meta.done <- nil
+		}
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if l.writeLargeRecords {
+		l.muInput.Lock()
+		if l.closed {
+			l.muInput.Unlock()
+			return ErrClosed
+		}
+		// maxBufSize changes only under muInput
+		if lenP > l.bufLimit()-1 {
+			// waits for room in the channel if it is full, as a blocking write may
+			l.queueDirect(rec, meta, true)
+			l.muInput.Unlock()
+			return nil
+		}
+		l.muInput.Unlock()
+	}
+
+	// size is set if the record can never fit into the buffer; it is reported after unlocking
+	var size int
+	defer func() {
+		if size > 0 && l.overflowWriter != nil {
+			err = l.spill(rec, meta)
+		} else if size > 0 {
+			l.skipped(1, SkippedTooLarge)
+			l.skippedRecord(rec)
+			l.tooLarge(lenP, size)
+		}
+	}()
+
+	l.muInternal.Lock()
+	defer l.muInternal.Unlock()
+
+	if lenP > l.bufLimit()-1 {
+		size = l.bufLimit()
+		return ErrRecordTooLarge
+	}
+
+	ticket := l.blockNext
+	l.blockNext++
+	l.blockQueue = append(l.blockQueue, ticket)
+	defer l.leaveBlockQueue(ticket)
+
+	stop := context.AfterFunc(ctx, func() {
+		l.muInternal.Lock()
+		l.spaceFreed.Broadcast()
+		l.muInternal.Unlock()
+	})
+	defer stop()
+
+	for {
+		for l.blockQueue[0] != ticket || (l.freeSize() < lenP && !l.growable()) || !l.roomFor(lenP) {
+			if l.closed {
+				return ErrClosed
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if lenP > l.bufLimit()-1 {
+				// the buffer has been made smaller by SetMaxBufSize
+				size = l.bufLimit()
+				return ErrRecordTooLarge
+			}
+			l.spaceFreed.Wait()
+		}
+		l.muInternal.Unlock()
+
+		l.muInput.Lock()
+		var count int
+		if !l.closed {
+			var buffers [2]part
+			var queued []part
+			buffers, count, queued, _ = l.allocMem(lenP, true)
+			if count > 0 {
+				l.enqueue(queued, buffers[:count], rec, meta)
+			}
+		}
+		l.muInput.Unlock()
+
+		l.muInternal.Lock()
+		if count > 0 {
+			return nil
+		}
+		if l.closed {
+			return ErrClosed
+		}
+	}
+}
+
+// leaveBlockQueue removes ticket from the queue of blocked writers and wakes the next one. It must be called under muInternal.
+func (l *LogWriter) leaveBlockQueue(ticket uint64) {
+	for i, t := range l.blockQueue {
+		if t == ticket {
+			l.blockQueue = append(l.blockQueue[:i], l.blockQueue[i+1:]...)
+			break
+		}
+	}
+	l.spaceFreed.Broadcast()
+}
+
+// enqueue copies the pieces of the record to the allocated parts and sends them to ioHandler after the queued parts
+// taken with them. It must be called under muInput.
+func (l *LogWriter) enqueue(queued []part, buffers []part, rec record, meta *partMeta) {
+	buffers[len(buffers)-1].meta = meta
+
+	rest := rec
+	pieces := rest[:]
+	for i := range buffers {
+		b := &buffers[i]
+		for n := b.sPos; n < b.ePos; {
+			for len(pieces[0]) == 0 {
+				pieces = pieces[1:]
+			}
+			c := copy((*b.pBuf)[n:b.ePos], pieces[0])
+			pieces[0] = pieces[0][c:]
+			n += c
+		}
+	}
+	l.send(queued)
+	l.send(buffers)
+	l.accepted(rec)
+}
+
+// accepted counts a queued record and passes it to the tailers.
+func (l *LogWriter) accepted(rec record) {
+	l.metrics.totalRecords.Add(1)
+	l.metrics.totalBytes.Add(uint64(rec.len()))
+
+	if atomic.LoadInt32(&l.numTailers) > 0 {
+		l.tail(rec)
+	}
+}
+
+// allocMem reserves lenP bytes in the buffer. If there is no space, it returns n == 0 and,
+// unless block is set, turns on skipping of new records; started reports that skipping has just been turned on.
+// With the space it takes the queued parts, which go to ioHandler before the record (see enqueue).
+func (l *LogWriter) allocMem(lenP int, block bool) (freeSlice [2]part, n int, queued []part, started bool) {
+	var freeBytes int
+
+	l.muInternal.Lock()
+	defer l.muInternal.Unlock()
+
+	if l.skipping == true && !block {
+		return
+	}
+
+	freeBytes = l.freeSize()
+	if freeBytes < lenP && l.growable() {
+		l.grow(lenP)
+		freeBytes = l.freeSize()
+	}
+
+	if freeBytes >= lenP && l.roomFor(lenP) {
+		freeSlice, n = l.reserve(lenP)
+		if n == 2 {
+			l.wrapped++
+		}
+		queued = l.takeQueued()
+	} else if !block {
+		l.skipping = true
+		started = true
+	}
+	return
+}
+
+// reserve moves endPos by lenP bytes and returns the parts covering them. It must be called under muInternal
+// after checking that there is enough free space.
+func (l *LogWriter) reserve(lenP int) (freeSlice [2]part, n int) {
+	oldEnd := l.endPos
+	l.endPos = (l.endPos + lenP) % l.maxBufSize
+	l.highWater = max(l.highWater, l.maxBufSize-1-l.freeSize())
+
+	if oldEnd < l.endPos {
+		//freeSlice[0] = l.buf[oldEnd:l.endPos]
+		freeSlice[0].setPart(l.buf, oldEnd, l.endPos, l.out)
+		n = 1
+	} else {
+		//freeSlice[0] = l.buf[oldEnd:]
+		freeSlice[0].setPart(l.buf, oldEnd, len(*l.buf), l.out)
+		n = 1
+		if l.endPos > 0 {
+			//freeSlice[1] = l.buf[:l.endPos]
+			freeSlice[1].setPart(l.buf, 0, l.endPos, l.out)
+			freeSlice[0].more = true
+			freeSlice[1].tail = true
+			n = 2
+		}
+	}
+	return
+}
+
+func (l *LogWriter) freeSize() int {
+	if l.startPos <= l.endPos {
+		return l.maxBufSize - (l.endPos - l.startPos) - 1
+	}
+
+	return l.startPos - l.endPos - 1
+}
+
+// SwapOutput writes everything buffered so far to the current Out and then switches to out.
+// Unlike Reset, SwapOutput keeps the buffer: nothing is reallocated and no buffered record is dropped or misrouted,
+// because writes are held off while the switch is queued.
+// SwapOutput returns when the old Out has received all its data, with the error of the last write to it;
+// after that the old Out can be closed.
+func (l *LogWriter) SwapOutput(out io.Writer) error {
+	return l.switchOutput(out, 0)
+}
+
+// MigrateTo starts a migration to out: everything buffered so far goes to the current Out only,
+// then for the window both the current Out and out receive every record, and after the window only out does.
+// This lets the new sink be checked before the old one is dropped, at the cost of doubled writes during the window.
+// MigrateTo returns when the migration has started, with the error of the last write to the current Out alone.
+// The old Out is written until the first flush after the window ends, so it can be closed only after that.
+// A Reset during the window ends the migration and writes only to the Out given to Reset.
+func (l *LogWriter) MigrateTo(out io.Writer, window time.Duration) error {
+	return l.switchOutput(out, window)
+}
+
+func (l *LogWriter) switchOutput(out io.Writer, window time.Duration) error {
+	if out == nil {
+		return errors.New("logwriter: nil Out")
+	}
+	return l.queueControl(&partMeta{done: make(chan error, 1), out: out, window: window})
+}
+
+// SetMaxBufSize replaces the buffer with a new one of n bytes, to grow it under load or shrink it under memory pressure.
+// New records go to the new buffer at once, while the records in the old one are written to Out as usual, in order;
+// SetMaxBufSize returns when they are written and the old buffer is released. Writes are paused briefly while the new buffer is installed.
+// It applies to Out only; the LogWriters of Outs have their own SetMaxBufSize.
+func (l *LogWriter) SetMaxBufSize(n int) error {
+	if n < 2 {
+		return errors.New("logwriter: MaxBufSize must be at least 2")
+	}
+
+	// no write may hold space in the old buffer while the new one is installed
+	l.muInput.Lock()
+	ok := l.reset(nil, n, 0)
+	l.muInput.Unlock()
+	if !ok {
+		return ErrClosed
+	}
+	l.notifyBackpressure()
+	<-l.retired()
+	return nil
+}
+
+// SetMaxRecordsInBuf changes the maximum number of records in the buffer without recreating the LogWriter.
+// Writes are paused briefly while a new queue of records is installed; records already queued are written as usual.
+// The new queue has ChannelCapacity slots if it is set, otherwise n+2.
+func (l *LogWriter) SetMaxRecordsInBuf(n int) error {
+	if n <= 0 {
+		return errors.New("logwriter: MaxRecordsInBuf must be positive")
+	}
+
+	l.muInput.Lock()
+	defer l.muInput.Unlock()
+	l.muInternal.Lock()
+	if l.closed {
+		l.muInternal.Unlock()
+		return ErrClosed
+	}
+	old, q := l.setMaxRecordsInBuf(n)
+	l.muInternal.Unlock()
+	for _, p := range q {
+		old <- p
+	}
+	return nil
+}
+
+// setMaxRecordsInBuf installs a new queue of records for n records. It must be called under muInput and muInternal.
+// It returns the old queue and the parts the caller must send to it after unlocking muInternal:
+// the queued parts and the part that moves ioHandler to the new queue.
+func (l *LogWriter) setMaxRecordsInBuf(n int) (chan part, []part) {
+	l.maxRecordsInBuf = n
+	old := l.inputRecords
+	l.inputRecords = make(chan part, l.capacity())
+	// the old queue is drained by ioHandler up to this part, then it continues with the new one
+	return old, append(l.takeQueued(), part{input: l.inputRecords})
+}
+
+// capacity returns the capacity of the channel of records.
+func (l *LogWriter) capacity() int {
+	if l.channelCapacity > 0 {
+		return l.channelCapacity
+	}
+	return l.maxRecordsInBuf + 2
+}
+
+// recordLimit returns the number of queued parts at which new records are not accepted:
+// MaxRecordsInBuf, lowered so that a record still fits into the channel with a slot to spare.
+func (l *LogWriter) recordLimit() int {
+	return min(l.maxRecordsInBuf, cap(l.inputRecords)-1)
+}
+
+// roomFor reports whether the channel takes a record of lenP bytes now, with the queued parts sent before it.
+// A record that wraps around the end of the buffer takes two slots. It must be called under muInternal.
+func (l *LogWriter) roomFor(lenP int) bool {
+	n := 1
+	if l.endPos+lenP > l.maxBufSize {
+		n = 2
+	}
+	return l.room(n)
+}
+
+// room reports whether the channel takes n more parts of records now. It must be called under muInternal.
+// Only the holder of muInput sends to the channel, so the room does not shrink before its send,
+// and a writer that has checked it never blocks on the channel. The last slot is kept for a control part,
+// such as that of Flush or Reset, so that it does not wait for ioHandler behind the records either.
+func (l *LogWriter) room(n int) bool {
+	return l.queuedLen() < l.recordLimit() && l.queuedLen()+n < cap(l.inputRecords)
+}
+
+// newTicker returns the ticker of FlashPeriod for ioHandler, with FlushJitter if it is set.
+func (l *LogWriter) newTicker(period time.Duration) ticker {
+	if l.flushJitter > 0 {
+		return newJitterTicker(l.clock, period, l.flushJitter)
+	}
+	return l.clock.NewTicker(period)
+}
+
+// rotate calls RotateHandler for out, the Out of the buffer cBuf, and returns the Out to write to from now on.
+// The new Out also becomes the Out of the LogWriter, kept by SetMaxBufSize, unless the buffer has been replaced meanwhile.
+func (l *LogWriter) rotate(cBuf *[]byte, out io.Writer) io.Writer {
+	w, err := l.rotateHandler(out)
+	if err != nil {
+		l.warn(fmt.Sprintf("logwriter: rotation failed: %v", err))
+		return out
+	}
+	if w == nil {
+		return out
+	}
+
+	l.muInternal.Lock()
+	if l.buf == cBuf {
+		l.out = w
+	}
+	l.muInternal.Unlock()
+	l.writeHeader(w)
+	return w
+}
+
+func (l *LogWriter) freeMem(cBuf *[]byte, lenP int) {
+	l.muInternal.Lock()
+	if cBuf != l.buf {
+		l.muInternal.Unlock()
+		return
+	}
+	l.sampleOccupancy()
+	l.startPos = (l.startPos + lenP) % l.maxBufSize
+	l.spaceFreed.Broadcast()
+	stopped := false
+	if l.skipping == true && l.freeSize() >= (l.maxBufSize/2) && l.queuedLen() < (l.recordLimit()/2) {
+		l.skipping = false
+		stopped = true
+	}
+	l.muInternal.Unlock()
+
+	if stopped {
+		l.notifyBackpressure()
+	}
+}
+
+// notifyBackpressure calls OnBackpressure if skipping has changed since the last call.
+// It reads the current state instead of taking it from the caller, so the calls alternate
+// even when the changes happen in different goroutines. It must not be called under muInput or muInternal.
+func (l *LogWriter) notifyBackpressure() {
+	if l.onBackpressure == nil {
+		return
+	}
+
+	l.muBackpressure.Lock()
+	defer l.muBackpressure.Unlock()
+	l.muInternal.Lock()
+	active := l.skipping
+	l.muInternal.Unlock()
+	if active != l.backpressure {
+		l.backpressure = active
+		l.onBackpressure(active)
+	}
+}
+
+// skipped counts n lost records by reason and reports them to SkipReasonHandler, and to SkipHandler if the buffer was full.
+func (l *LogWriter) skipped(n int, reason SkipReason) {
+	switch reason {
+	case SkippedTooLarge:
+		l.metrics.tooLargeRecords.Add(uint64(n))
+	case SkippedBusy:
+		l.metrics.busyRecords.Add(uint64(n))
+	case DroppedCircuitOpen:
+		l.metrics.circuitDroppedRecords.Add(uint64(n))
+	default:
+		// the buffer was full
+		l.metrics.skippedRecords.Add(uint64(n))
+		if l.skipHandler != nil {
+			l.skipHandler(n)
+		}
+	}
+	if l.skipReasonHandler != nil {
+		l.skipReasonHandler(n, reason)
+	}
+	if l.namedSkipHandler != nil {
+		l.namedSkipHandler(l.name, n, reason)
+	}
+}
+
+// circuitDropped reports n records of size bytes discarded by the circuit breaker.
+func (l *LogWriter) circuitDropped(n, size int) {
+	l.metrics.circuitDroppedBytes.Add(uint64(size))
+	if n > 0 {
+		l.skipped(n, DroppedCircuitOpen)
+	}
+}
+
+// skippedRecord passes a skipped record to SkipHandlerBytes.
+func (l *LogWriter) skippedRecord(rec record) {
+	if l.skipHandlerBytes == nil {
+		return
+	}
+	b := rec[2]
+	if len(b) != rec.len() {
+		// join the record with its framing
+		b = make([]byte, 0, rec.len())
+		for _, piece := range rec {
+			b = append(b, piece...)
+		}
+	}
+	l.skipHandlerBytes(b)
+}
+
+// warn reports an internal problem to InternalLogger. It must not be called under muInput or muInternal.
+func (l *LogWriter) warn(msg string) {
+	if l.internalLogger != nil {
+		l.internalLogger(msg)
+	}
+}
+
+func (l *LogWriter) writeHeader(out io.Writer) {
+	if l.headerFunc == nil {
+		return
+	}
+	if header := l.headerFunc(); len(header) > 0 {
+		l.write(header, out)
+	}
+}
+
+func (l *LogWriter) write(p []byte, out io.Writer) error {
+	return l.writeParts(p, nil, out)
+}
+
+// writeParts writes p and then q to out as one write: with a single call if out is vectored (see WritevWriter),
+// otherwise joined into a copy. q may be nil.
+func (l *LogWriter) writeParts(p, q []byte, out io.Writer) error {
+	if l.abandoned.Load() {
+		return ErrCloseTimeout
+	}
+	if !l.breaker.allow(l.clock.Now()) {
+		return ErrCircuitOpen
+	}
+
+	writeFunc := writeOutParts
+	if l.writeTimeout > 0 {
+		writeFunc = l.writeOutTimeout
+	}
+	n, err := writeFunc(p, q, out)
+	for i := 0; err != nil && i < l.retryCount && !l.abandoned.Load(); i++ {
+		if l.retryDelay > 0 {
+			<-l.clock.After(l.retryDelay)
+		}
+		// continue after the bytes already written
+		restP, restQ := rest(p, q, n)
+		c, retryErr := writeFunc(restP, restQ, out)
+		n += c
+		err = retryErr
+	}
+	l.metrics.bytesWritten.Add(uint64(n))
+	if err != nil {
+		now := l.clock.Now()
+		l.breaker.failure(now)
+		if !l.breaker.allow(now) {
+			l.warn(fmt.Sprintf("logwriter: %d consecutive write errors, pausing writes for %v: %v", l.breaker.failures, l.breaker.cooldown, err))
+		} else if errors.Is(err, ErrWritePanic) {
+			l.warn(err.Error())
+		}
+		var pe *PanicError
+		if l.recoverHandler != nil && errors.As(err, &pe) {
+			l.recoverHandler(pe.Value, pe.Stack)
+		}
+		l.writeFailed(out, err, now)
+		return err
+	}
+	l.breaker.success()
+	if l.stallTimeout > 0 {
+		l.progress.Store(l.clock.Now().UnixNano())
+	}
+	if l.postWriteHandler != nil {
+		l.postWrite(out, n)
+	}
+	return nil
+}
+
+// writeFailed counts a failed write or Sync of out at now, for Metrics and Healthy, and reports it to the write error handlers.
+func (l *LogWriter) writeFailed(out io.Writer, err error, now time.Time) {
+	l.metrics.writeErrors.Add(1)
+	l.muInternal.Lock()
+	l.lastError = now
+	l.muInternal.Unlock()
+	if l.writeErrorHandler != nil {
+		l.writeErrorHandler(out)
+	}
+	if l.writeErrorHandlerErr != nil {
+		l.writeErrorHandlerErr(out, err)
+	}
+	if l.namedErrorHandler != nil {
+		l.namedErrorHandler(l.name, out, err)
+	}
+}
+
+// postWrite calls PostWriteHandler, recovering from its panic.
+func (l *LogWriter) postWrite(out io.Writer, n int) {
+	defer func() {
+		if r := recover(); r != nil {
+			l.warn(fmt.Sprintf("logwriter: PostWriteHandler panicked: %v", r))
+		}
+	}()
+	l.postWriteHandler(out, n)
+}
+
+// hungWrite is a write to out given up after WriteTimeout.
+type hungWrite struct {
+	out io.Writer
+}
+
+// writeOutTimeout is writeOutParts that gives up after writeTimeout and returns ErrWriteTimeout.
+// The write goes on in the background with a copy of p, as the buffer space of p is reused once the write is over for ioHandler.
+// While it is running, writes to the same out fail at once.
+func (l *LogWriter) writeOutTimeout(p, q []byte, out io.Writer) (int, error) {
+	if l.isHung(out) {
+		return 0, ErrWriteTimeout
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	// the copy joins p and q too
+	b := append(bytes.Clone(p), q...)
+	go func() {
+		n, err := writeOut(b, out)
+		done <- result{n, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-l.clock.After(l.writeTimeout):
+	}
+
+	h := &hungWrite{out: out}
+	l.muHung.Lock()
+	l.hung = append(l.hung, h)
+	l.muHung.Unlock()
+	go func() {
+		// the result of the late write is dropped: the data counts as failed already
+		<-done
+		l.muHung.Lock()
+		defer l.muHung.Unlock()
+		for i := range l.hung {
+			if l.hung[i] == h {
+				l.hung = append(l.hung[:i], l.hung[i+1:]...)
+				break
+			}
+		}
+	}()
+	return 0, ErrWriteTimeout
+}
+
+// isHung tells whether a write to out has timed out and not returned yet.
+func (l *LogWriter) isHung(out io.Writer) bool {
+	l.muHung.Lock()
+	defer l.muHung.Unlock()
+
+	for _, h := range l.hung {
+		if sameWriter(h.out, out) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameWriter compares two writers without panicking on uncomparable types, which are taken for the same if the types match.
+func sameWriter(a, b io.Writer) bool {
+	t := reflect.TypeOf(a)
+	if t != reflect.TypeOf(b) {
+		return false
+	}
+	return !t.Comparable() || a == b
+}
+
+// writeOut writes p to out, repeating short writes, and returns the number of bytes written.
+// A short write without an error is retried; a write of no bytes without an error returns io.ErrShortWrite.
+func writeOut(p []byte, out io.Writer) (n int, err error) {
+	return writeOutParts(p, nil, out)
+}
+
+// writeOutParts is writeOut for p followed by q. A vectored out gets both with one call, any other out gets a joined copy.
+func writeOutParts(p, q []byte, out io.Writer) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+
+	if len(q) > 0 {
+		if vectored(out) {
+			return writev(p, q, out)
+		}
+		p = append(bytes.Clone(p), q...)
+	}
+	for n < len(p) {
+		var c int
+		c, err = out.Write(p[n:])
+		n += c
+		if err != nil {
+			return n, err
+		}
+		if c == 0 {
+			return n, io.ErrShortWrite
 		}
 	}
+	return n, nil
 }
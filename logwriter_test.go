@@ -2,33 +2,48 @@ package logwriter
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
+
+	"github.com/oleg-safonov/logwriter/logwritertest"
 )
 
 func testSleep(times int) {
 	time.Sleep(time.Duration(times) * time.Millisecond)
 }
 
+// testBufSize and testChannelCapacity keep the LogWriters of tests small; with the defaults each one takes about 64 MB.
+const (
+	testBufSize         = 1 << 16
+	testChannelCapacity = 256
+)
+
 type testBuffer struct {
 	buf      bytes.Buffer
 	delay    time.Duration
-	failbit  bool
 	panicbit bool
+	calls    int
+	chunks   []string
 }
 
 func (tb *testBuffer) Write(p []byte) (int, error) {
-	if tb.failbit {
-		return 0, fmt.Errorf("write error")
-	}
-
+	tb.calls++
 	if tb.panicbit {
 		panic("write error")
 	}
 	time.Sleep(tb.delay)
+	tb.chunks = append(tb.chunks, string(p))
 	tb.buf.Write(p)
 	return len(p), nil
 }
@@ -58,7 +73,8 @@ func ExampleLogWriter() {
 
 func TestCreateWriter(t *testing.T) {
 	var tb testBuffer
-	lg := New(LogConfig{Out: &tb})
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	defer lg.Close()
 	lg.Write([]byte("test"))
 	testSleep(200)
 }
@@ -67,12 +83,13 @@ func TestZeroBuffer(t *testing.T) {
 	var tb testBuffer
 	tb.delay = 30 * time.Millisecond
 	lg := New(LogConfig{Out: &tb, MaxBufSize: 8, MaxRecordsInBuf: 3})
+	defer lg.Close()
 
 	for i := 0; i < 100; i++ {
 		lg.Write([]byte(""))
 	}
 	lg.Write([]byte("test"))
-	testSleep(200)
+	lg.Flush()
 
 	if tb.buf.String() != "test" {
 		t.Error("Expected output = test, got", tb.buf.String())
@@ -93,13 +110,14 @@ func TestBufferOverflow(t *testing.T) {
 		MaxRecordsInBuf:   3,
 		SkipHandler:       fSkipCounter,
 		WriteErrorHandler: fErrorCounter})
+	defer lg.Close()
 
 	lg.Write([]byte("t1"))
 	lg.Write([]byte("t2"))
 	lg.Write([]byte("t3"))
 	lg.Write([]byte("t4"))
 
-	testSleep(200)
+	lg.Flush()
 	if tb.buf.String() != "t1t2t3" {
 		t.Error("Expected output = t1t2t3, got", tb.buf.String())
 	}
@@ -107,9 +125,9 @@ func TestBufferOverflow(t *testing.T) {
 	lg.Write([]byte("test1"))
 	lg.Write([]byte("test2"))
 	lg.Write([]byte("test3"))
-	testSleep(200)
+	lg.Flush()
 	lg.Write([]byte("test4"))
-	testSleep(200)
+	lg.Flush()
 	if tb.buf.String() != "t1t2t3test1test4" {
 		t.Error("Expected output = t1t2t3test1test4, got", tb.buf.String())
 	}
@@ -123,6 +141,120 @@ func TestBufferOverflow(t *testing.T) {
 	}
 }
 
+func TestRecordTooLarge(t *testing.T) {
+	var tb testBuffer
+	var reasons []SkipReason
+	var msgs []string
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:        16,
+		FlashPeriod:       time.Hour,
+		SkipReasonHandler: func(n int, reason SkipReason) { reasons = append(reasons, reason) },
+		InternalLogger:    func(msg string) { msgs = append(msgs, msg) }})
+	defer lg.Close()
+
+	n, err := lg.Write([]byte("0123456789abcdef"))
+	if n != 0 || err != ErrRecordTooLarge || !errors.Is(err, ErrDropped) {
+		t.Error("Expected 0, ErrRecordTooLarge, got", n, err)
+	}
+	// the records after it are not skipped
+	lg.Write([]byte("test1"))
+	lg.Flush()
+	if tb.buf.String() != "test1" {
+		t.Error("Expected output = test1, got", tb.buf.String())
+	}
+	if len(reasons) != 1 || reasons[0] != SkippedTooLarge {
+		t.Error("Expected reasons = [SkippedTooLarge], got", reasons)
+	}
+	if len(msgs) != 1 || !strings.Contains(msgs[0], "16 bytes") {
+		t.Error("Expected a message about the record, got", msgs)
+	}
+}
+
+func TestWriteLargeRecords(t *testing.T) {
+	var tb testBuffer
+	var skipCount int
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:        16,
+		FlashPeriod:       time.Hour,
+		WriteLargeRecords: true,
+		SkipHandler:       func(n int) { skipCount += n }})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	if n, err := lg.Write([]byte("0123456789abcdefghij")); n != 20 || err != nil {
+		t.Error("Expected 20, nil, got", n, err)
+	}
+	lg.Write([]byte("test2"))
+	if err := lg.WriteAndWait([]byte("klmnopqrstuvwxyz")); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+
+	expected := []string{"test1", "0123456789abcdefghij", "test2", "klmnopqrstuvwxyz"}
+	if fmt.Sprint(tb.chunks) != fmt.Sprint(expected) {
+		t.Error("Expected writes", expected, "got", tb.chunks)
+	}
+	if skipCount != 0 {
+		t.Error("Expected skipCount = 0, got", skipCount)
+	}
+}
+
+func TestWriteLargeRecordsFullChannel(t *testing.T) {
+	hw := &hungWriter{release: make(chan struct{})}
+	var skipCount atomic.Int64
+	lg := New(LogConfig{Out: hw, ChannelCapacity: 2,
+		MaxBufSize:        16,
+		WriteLargeRecords: true,
+		SkipHandler:       func(n int) { skipCount.Add(int64(n)) }})
+	defer lg.Close()
+	defer close(hw.release)
+
+	// the writes must not wait for the hung Out: the records that find no room in the channel are skipped
+	written := make(chan struct{})
+	go func() {
+		for i := 0; i < 8; i++ {
+			lg.Write([]byte("0123456789abcdefghij"))
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write of a large record blocked on the full channel")
+	}
+	if skipCount.Load() == 0 {
+		t.Error("Expected large records to be skipped")
+	}
+}
+
+func TestReportErrors(t *testing.T) {
+	var skipCount int
+	var tb testBuffer
+	tb.delay = 30 * time.Millisecond
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:   8,
+		ReportErrors: true,
+		SkipHandler:  func(n int) { skipCount += n }})
+	defer lg.Close()
+
+	if n, err := lg.Write([]byte("test1")); n != 5 || err != nil {
+		t.Error("Expected 5, nil, got", n, err)
+	}
+	n, err := lg.Write([]byte("test2"))
+	if n != 0 || !errors.Is(err, ErrDropped) {
+		t.Error("Expected 0, ErrDropped, got", n, err)
+	}
+	if skipCount != 1 {
+		t.Error("Expected skipCount = 1, got", skipCount)
+	}
+
+	lg = New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 8})
+	defer lg.Close()
+	lg.Write([]byte("test1"))
+	if n, err := lg.Write([]byte("test2")); n != 5 || err != nil {
+		t.Error("Expected 5, nil, got", n, err)
+	}
+}
+
 func TestWriteError(t *testing.T) {
 	var skipCount int
 	var errorCount int
@@ -133,19 +265,19 @@ func TestWriteError(t *testing.T) {
 	fSkipCounter := func(n int) { skipCount += n }
 	fErrorCounter := func(out io.Writer) { errorCount += 1 }
 
-	lg := New(LogConfig{Out: &tb,
+	lg := New(LogConfig{Out: logwritertest.NewLimitedWriter(&tb, 15),
 		MaxBufSize:        25,
 		MaxRecordsInBuf:   5,
 		SkipHandler:       fSkipCounter,
 		WriteErrorHandler: fErrorCounter})
+	defer lg.Close()
 
 	lg.Write([]byte("test1"))
 	lg.Write([]byte("test2"))
 	lg.Write([]byte("test3"))
-	testSleep(200)
-	tb.failbit = true
+	lg.Flush()
 	lg.Write([]byte("test4"))
-	testSleep(300)
+	lg.Flush()
 	if tb.buf.String() != "test1test2test3" {
 		t.Error("Expected output = test1test2test3, got", tb.buf.String())
 	}
@@ -159,6 +291,196 @@ func TestWriteError(t *testing.T) {
 	}
 }
 
+func TestWriteErrorHandlerErr(t *testing.T) {
+	var tb testBuffer
+	var errs []error
+	out := logwritertest.NewLimitedWriter(&tb, 0)
+	lg := New(LogConfig{Out: out, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, WriteErrorHandlerErr: func(w io.Writer, err error) {
+		if w != out {
+			t.Error("Expected the failed Out, got", w)
+		}
+		errs = append(errs, err)
+	}})
+	defer lg.Close()
+
+	lg.WriteAndWait([]byte("test1"))
+	out.N = 100
+	tb.panicbit = true
+	lg.WriteAndWait([]byte("test2"))
+
+	if len(errs) != 2 || errs[0] != logwritertest.ErrLimit || !errors.Is(errs[1], ErrWritePanic) {
+		t.Error("Expected ErrLimit and ErrWritePanic, got", errs)
+	}
+	var pe *PanicError
+	if len(errs) == 2 && (!errors.As(errs[1], &pe) || pe.Value == nil) {
+		t.Error("Expected PanicError with the panic value, got", errs[1])
+	}
+}
+
+func TestRecoverHandler(t *testing.T) {
+	var tb testBuffer
+	var events []string
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity,
+		RecoverHandler: func(recovered any, stack []byte) {
+			if !bytes.Contains(stack, []byte("(*testBuffer).Write")) {
+				t.Error("Expected the stack of the panicking Write, got", string(stack))
+			}
+			events = append(events, fmt.Sprint("recover: ", recovered))
+		},
+		WriteErrorHandler: func(io.Writer) { events = append(events, "error") }})
+	defer lg.Close()
+
+	tb.panicbit = true
+	if err := lg.WriteAndWait([]byte("test1")); !errors.Is(err, ErrWritePanic) {
+		t.Error("Expected ErrWritePanic, got", err)
+	}
+	if !slices.Equal(events, []string{"recover: write error", "error"}) {
+		t.Error("Expected the panic before the write error, got", events)
+	}
+}
+
+func TestPostWriteHandler(t *testing.T) {
+	var tb testBuffer
+	var sizes []int
+	var msgs []string
+	lg := New(LogConfig{Out: logwritertest.NewLimitedWriter(&tb, 10), MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity,
+		FlashPeriod: time.Hour,
+		PostWriteHandler: func(out io.Writer, n int) {
+			sizes = append(sizes, n)
+			if n == 2 {
+				panic("sync failed")
+			}
+		},
+		InternalLogger: func(msg string) { msgs = append(msgs, msg) }})
+	defer lg.Close()
+
+	lg.WriteAndWait([]byte("test1"))
+	lg.WriteAndWait([]byte("t2"))
+	// fails, no call
+	lg.WriteAndWait([]byte("test3"))
+	lg.Close()
+
+	if fmt.Sprint(sizes) != "[5 2]" {
+		t.Error("Expected sizes [5 2], got", sizes)
+	}
+	if len(msgs) != 1 || !strings.Contains(msgs[0], "sync failed") {
+		t.Error("Expected the panic to be reported, got", msgs)
+	}
+}
+
+func TestReopenHandler(t *testing.T) {
+	var tb1, tb2 testBuffer
+	var reopened []io.Writer
+	out1 := logwritertest.NewLimitedWriter(&tb1, 7)
+	lg := New(LogConfig{Out: out1, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity,
+		HeaderFunc: func() []byte { return []byte("h:") },
+		ReopenHandler: func(out io.Writer) (io.Writer, error) {
+			reopened = append(reopened, out)
+			if len(reopened) > 1 {
+				return nil, errors.New("no more files")
+			}
+			return &tb2, nil
+		}})
+	defer lg.Close()
+
+	if err := lg.WriteAndWait([]byte("test1")); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if err := lg.WriteAndWait([]byte("test2")); err != nil {
+		t.Error("Expected nil error after reopen, got", err)
+	}
+	if len(reopened) != 1 || reopened[0] != out1 {
+		t.Error("Expected one reopen of Out, got", reopened)
+	}
+	if tb2.buf.String() != "h:test2" {
+		t.Error("Expected output = h:test2, got", tb2.buf.String())
+	}
+
+	lg.Reset(logwritertest.NewLimitedWriter(&tb1, 0))
+	if err := lg.WriteAndWait([]byte("test3")); err != logwritertest.ErrLimit {
+		t.Error("Expected ErrLimit, got", err)
+	}
+	if len(reopened) != 2 {
+		t.Error("Expected reopen count = 2, got", len(reopened))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var tb testBuffer
+	var errorCount int
+	out := logwritertest.NewLimitedWriter(&tb, 0)
+	clk := &fakeClock{after: make(chan time.Time), waiting: make(chan time.Duration)}
+	lg := New(LogConfig{Out: out, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity,
+		RetryCount:        3,
+		RetryDelay:        time.Second,
+		WriteErrorHandler: func(io.Writer) { errorCount++ },
+		clock:             clk})
+	defer lg.Close()
+
+	done := make(chan error)
+	go func() { done <- lg.WriteAndWait([]byte("test1")) }()
+	for i := 0; i < 2; i++ {
+		if d := <-clk.waiting; d != time.Second {
+			t.Error("Expected retry delay = 1s, got", d)
+		}
+		if i == 1 {
+			out.N = 100
+		}
+		clk.after <- clk.Now()
+	}
+	if err := <-done; err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if tb.buf.String() != "test1" || errorCount != 0 {
+		t.Error("Expected output = test1 without errors, got", tb.buf.String(), errorCount)
+	}
+
+	out.N = 0
+	go func() { done <- lg.WriteAndWait([]byte("test2")) }()
+	for i := 0; i < 3; i++ {
+		<-clk.waiting
+		clk.after <- clk.Now()
+	}
+	if err := <-done; err != logwritertest.ErrLimit {
+		t.Error("Expected ErrLimit, got", err)
+	}
+	if errorCount != 1 {
+		t.Error("Expected errorCount = 1, got", errorCount)
+	}
+}
+
+// shortWriter writes at most max bytes per call without an error.
+type shortWriter struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.buf.Write(p)
+}
+
+func TestShortWrite(t *testing.T) {
+	out := &shortWriter{max: 3}
+	lg := New(LogConfig{Out: out, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	if err := lg.WriteAndWait([]byte("test2")); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if out.buf.String() != "test1test2" {
+		t.Error("Expected output = test1test2, got", out.buf.String())
+	}
+
+	out.max = 0
+	if err := lg.WriteAndWait([]byte("test3")); err != io.ErrShortWrite {
+		t.Error("Expected io.ErrShortWrite, got", err)
+	}
+}
+
 func TestWritePanic(t *testing.T) {
 	var skipCount int
 	var errorCount int
@@ -173,14 +495,15 @@ func TestWritePanic(t *testing.T) {
 		MaxRecordsInBuf:   5,
 		SkipHandler:       fSkipCounter,
 		WriteErrorHandler: fErrorCounter})
+	defer lg.Close()
 
 	lg.Write([]byte("test1"))
 	lg.Write([]byte("test2"))
 	lg.Write([]byte("test3"))
-	testSleep(200)
+	lg.Flush()
 	tb.panicbit = true
 	lg.Write([]byte("test4"))
-	testSleep(300)
+	lg.Flush()
 	if tb.buf.String() != "test1test2test3" {
 		t.Error("Expected output = test1test2test3, got", tb.buf.String())
 	}
@@ -202,7 +525,8 @@ func TestReset(t *testing.T) {
 	tb2.delay = 200 * time.Millisecond
 	tb3.delay = 200 * time.Millisecond
 
-	lg := New(LogConfig{Out: &tb1, FlashPeriod: 100 * time.Millisecond})
+	lg := New(LogConfig{Out: &tb1, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: 100 * time.Millisecond})
+	defer lg.Close()
 
 	lg.Write([]byte("test1"))
 	testSleep(20)
@@ -214,7 +538,7 @@ func TestReset(t *testing.T) {
 	testSleep(20)
 
 	go lg.Reset(&tb3)
-	testSleep(400)
+	lg.Close()
 
 	if tb1.buf.String() != "test1" {
 		t.Error("Expected output = test1, got", tb1.buf.String())
@@ -225,6 +549,299 @@ func TestReset(t *testing.T) {
 	}
 }
 
+// retiringWriter fails the test if it is written after it has been retired.
+type retiringWriter struct {
+	t       *testing.T
+	retired atomic.Bool
+	mu      sync.Mutex
+	buf     bytes.Buffer
+}
+
+func (w *retiringWriter) Write(p []byte) (int, error) {
+	if w.retired.Load() {
+		w.t.Error("Expected no writes to an Out replaced by a finished Reset")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func TestConcurrentReset(t *testing.T) {
+	first := &retiringWriter{t: t}
+	lg := New(LogConfig{Out: first, ChannelCapacity: testChannelCapacity, MaxBufSize: 1024, FlashPeriod: time.Millisecond})
+	defer lg.Close()
+
+	// finished holds the Outs whose Reset has returned; they were switched to before any Reset started later,
+	// so the return of that Reset means they are drained
+	var mu sync.Mutex
+	finished := []*retiringWriter{first}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				mu.Lock()
+				before := append([]*retiringWriter(nil), finished...)
+				mu.Unlock()
+
+				w := &retiringWriter{t: t}
+				lg.Reset(w)
+				for _, old := range before {
+					old.retired.Store(true)
+				}
+
+				mu.Lock()
+				finished = append(finished, w)
+				mu.Unlock()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				lg.Write([]byte("test"))
+			}
+		}()
+	}
+	wg.Wait()
+	lg.Close()
+}
+
+func TestResetHandoff(t *testing.T) {
+	const writers, records = 4, 500
+	first := &retiringWriter{t: t}
+	lg := New(LogConfig{Out: first, ChannelCapacity: testChannelCapacity, MaxBufSize: 1 << 14, FlashPeriod: time.Millisecond, OverflowPolicy: OverflowBlock})
+	defer lg.Close()
+	// long records widen the window between taking space in the buffer and queueing it
+	padding := strings.Repeat(".", 1000)
+
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				rec := []byte(fmt.Sprintf("%d %d %s\n", g, i, padding))
+				if i%10 == 0 {
+					lg.WriteAndWait(rec)
+				} else {
+					lg.Write(rec)
+				}
+			}
+		}(g)
+	}
+	stop := make(chan struct{})
+	resets := make(chan []*retiringWriter)
+	go func() {
+		outs := []*retiringWriter{first}
+		for {
+			select {
+			case <-stop:
+				resets <- outs
+				return
+			default:
+			}
+			w := &retiringWriter{t: t}
+			lg.Reset(w)
+			// the Out replaced by the Reset has got all its records
+			outs[len(outs)-1].retired.Store(true)
+			outs = append(outs, w)
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	outs := <-resets
+	lg.Close()
+
+	// every record is in exactly one Out, and the records of a writer are in order in each Out
+	seen := make([][]bool, writers)
+	for g := range seen {
+		seen[g] = make([]bool, records)
+	}
+	for _, w := range outs {
+		last := make([]int, writers)
+		for g := range last {
+			last[g] = -1
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(w.buf.String(), "\n"), "\n") {
+			if line == "" {
+				continue
+			}
+			var g, i int
+			if _, err := fmt.Sscanf(line, "%d %d", &g, &i); err != nil || g < 0 || g >= writers || i < 0 || i >= records {
+				t.Fatalf("Expected a record, got %q", line)
+			}
+			if seen[g][i] {
+				t.Errorf("Expected record %d of writer %d once, got it again", i, g)
+			}
+			if i <= last[g] {
+				t.Errorf("Expected record %d of writer %d after %d", i, g, last[g])
+			}
+			seen[g][i] = true
+			last[g] = i
+		}
+	}
+	for g := range seen {
+		for i, ok := range seen[g] {
+			if !ok {
+				t.Errorf("Expected record %d of writer %d, it is lost", i, g)
+			}
+		}
+	}
+	if len(outs) < 2 {
+		t.Error("Expected resets during the writes, got", len(outs)-1)
+	}
+}
+
+func TestResetStrayRecord(t *testing.T) {
+	var tb1, tb2 testBuffer
+	lg := New(LogConfig{Out: &tb1, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	// a Write takes space in the buffer, then Reset replaces the buffer before the record is queued
+	lg.muInput.Lock()
+	buffers, n, queued, _ := lg.allocMem(5, false)
+	reset := make(chan struct{})
+	go func() {
+		lg.Reset(&tb2)
+		close(reset)
+	}()
+	for {
+		lg.muInternal.Lock()
+		switched := lg.out == &tb2
+		lg.muInternal.Unlock()
+		if switched {
+			break
+		}
+		testSleep(1)
+	}
+	lg.enqueue(queued, buffers[:n], record{2: []byte("test1")}, nil)
+	lg.muInput.Unlock()
+
+	// Reset waits for the record, which goes to the old Out
+	<-reset
+	if tb1.buf.String() != "test1" {
+		t.Error("Expected old output = test1, got", tb1.buf.String())
+	}
+	lg.Write([]byte("test2"))
+	lg.Flush()
+	if tb2.buf.String() != "test2" || lg.Len() != 0 {
+		t.Error("Expected new output = test2 and an empty buffer, got", tb2.buf.String(), lg.Len())
+	}
+	lg.Close()
+}
+
+func TestRapidReset(t *testing.T) {
+	var tb testBuffer
+	// the queue of records is shorter than the number of resets
+	lg := New(LogConfig{Out: &tb, MaxBufSize: 64, MaxRecordsInBuf: 1})
+	defer lg.Close()
+
+	// completion signals are closed channels, so nobody has to take them: neither waits that gave up nor finished ones stall ioHandler
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 50; i++ {
+		lg.ResetContext(ctx, io.Discard)
+	}
+	for i := 0; i < 50; i++ {
+		lg.Reset(io.Discard)
+	}
+	lg.Reset(&tb)
+
+	done := make(chan error, 1)
+	go func() { done <- lg.WriteAndWait([]byte("test1")) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Expected no error, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected WriteAndWait to return after rapid resets")
+	}
+	if tb.buf.String() != "test1" {
+		t.Error("Expected output = test1, got", tb.buf.String())
+	}
+}
+
+func TestResetContext(t *testing.T) {
+	var tb1, tb2, tb3 testBuffer
+	tb1.delay = 200 * time.Millisecond
+	lg := New(LogConfig{Out: &tb1, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := lg.ResetContext(ctx, &tb2); err != context.DeadlineExceeded {
+		t.Error("Expected DeadlineExceeded, got", err)
+	}
+	lg.Write([]byte("test2"))
+
+	if err := lg.ResetContext(context.Background(), &tb3); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if tb1.buf.String() != "test1" || tb2.buf.String() != "test2" {
+		t.Error("Expected output = test1, test2, got", tb1.buf.String(), tb2.buf.String())
+	}
+
+	lg.Close()
+	if err := lg.ResetContext(context.Background(), &tb1); err != ErrClosed {
+		t.Error("Expected ErrClosed, got", err)
+	}
+}
+
+func TestLastResetDrained(t *testing.T) {
+	var tb1, tb2, tb3 testBuffer
+	tb1.delay = 200 * time.Millisecond
+	lg := New(LogConfig{Out: &tb1, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	defer lg.Close()
+
+	if !lg.LastResetDrained() {
+		t.Error("Expected LastResetDrained = true before any reset")
+	}
+	lg.Write([]byte("test1"))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	lg.ResetContext(ctx, &tb2)
+	if lg.LastResetDrained() {
+		t.Error("Expected LastResetDrained = false after an abandoned ResetContext")
+	}
+
+	lg.Write([]byte("test2"))
+	lg.ResetContext(context.Background(), &tb3)
+	if !lg.LastResetDrained() {
+		t.Error("Expected LastResetDrained = true after a drained ResetContext")
+	}
+	if tb2.buf.String() != "test2" {
+		t.Error("Expected output = test2, got", tb2.buf.String())
+	}
+}
+
+func TestResetAndFlush(t *testing.T) {
+	var tb1, tb2, tb3 testBuffer
+	lg := New(LogConfig{Out: &tb1, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, HeaderFunc: func() []byte { return []byte("#") }})
+	defer lg.Close()
+
+	lg.WriteAndWait([]byte("test1"))
+	lg.Write([]byte("test2"))
+	if n, err := lg.ResetAndFlush(&tb2); n != 10 || err != nil {
+		t.Error("Expected 10, nil, got", n, err)
+	}
+	lg.Write([]byte("test33"))
+	if n, err := lg.ResetAndFlush(&tb3); n != 6 || err != nil {
+		t.Error("Expected 6, nil, got", n, err)
+	}
+	if tb1.buf.String() != "#test1test2" || tb2.buf.String() != "#test33" {
+		t.Error("Expected output = #test1test2, #test33, got", tb1.buf.String(), tb2.buf.String())
+	}
+
+	lg.Close()
+	if _, err := lg.ResetAndFlush(&tb1); err != ErrClosed {
+		t.Error("Expected ErrClosed, got", err)
+	}
+}
+
 func TestReset2(t *testing.T) {
 	var skipCount int
 	var errorCount int
@@ -242,6 +859,7 @@ func TestReset2(t *testing.T) {
 		FlashPeriod:       300 * time.Millisecond,
 		SkipHandler:       fSkipCounter,
 		WriteErrorHandler: fErrorCounter})
+	defer lg.Close()
 
 	lg.Write([]byte("test1"))
 	lg.Write([]byte("test2"))
@@ -249,7 +867,7 @@ func TestReset2(t *testing.T) {
 	go lg.Reset(&tb2)
 	testSleep(100)
 	lg.Write([]byte("test3"))
-	testSleep(300)
+	lg.Close()
 
 	if tb1.buf.String() != "test1test2" {
 		t.Error("Expected output = test1test2, got", tb1.buf.String())
@@ -273,15 +891,16 @@ func Test4kDump(t *testing.T) {
 
 	var tb testBuffer
 	tb.delay = 100 * time.Millisecond
-	lg := New(LogConfig{Out: &tb,
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, MaxRecordsInBuf: 2000,
 		SkipHandler:       fSkipCounter,
 		WriteErrorHandler: fErrorCounter})
+	defer lg.Close()
 
 	for i := 0; i < 1000; i++ {
 		lg.Write([]byte("test1"))
 	}
 
-	testSleep(1200)
+	lg.Flush()
 
 	if len(tb.buf.String()) != 5000 {
 		t.Error("Expected output length = 5000, got", len(tb.buf.String()))
@@ -309,7 +928,9 @@ func benchmarkWrite(b *testing.B, line []byte) {
 		MaxRecordsInBuf:   5000000,
 		SkipHandler:       fSkipCounter,
 		WriteErrorHandler: fErrorCounter})
+	defer lg.Close()
 
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		lg.Write(line)
@@ -327,3 +948,1576 @@ func BenchmarkWrite100b(b *testing.B) {
 	}
 	benchmarkWrite(b, line)
 }
+
+func benchmarkWriteString(b *testing.B, convert bool) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb,
+		MaxBufSize:      100 * b.N,
+		MaxRecordsInBuf: 5000000})
+	defer lg.Close()
+	line := strings.Repeat("t", 100)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if convert {
+			lg.Write([]byte(line))
+		} else {
+			lg.WriteString(line)
+		}
+	}
+}
+
+func BenchmarkWriteString100b(b *testing.B) {
+	benchmarkWriteString(b, false)
+}
+
+func BenchmarkWriteConvertedString100b(b *testing.B) {
+	benchmarkWriteString(b, true)
+}
+
+func TestTail(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	defer lg.Close()
+
+	ch1, cancel1 := lg.Tail()
+	ch2, cancel2 := lg.Tail()
+	defer cancel2()
+
+	lg.Write([]byte("test1"))
+	if r := string(<-ch1); r != "test1" {
+		t.Error("Expected tail1 = test1, got", r)
+	}
+	if r := string(<-ch2); r != "test1" {
+		t.Error("Expected tail2 = test1, got", r)
+	}
+
+	cancel1()
+	cancel1()
+	if _, ok := <-ch1; ok {
+		t.Error("Expected closed channel after cancel")
+	}
+
+	for i := 0; i < 2*tailChanSize; i++ {
+		lg.Write([]byte("test2"))
+	}
+	if len(ch2) != tailChanSize {
+		t.Error("Expected slow tailer to drop records, got", len(ch2))
+	}
+
+	lg.Flush()
+	if len(tb.buf.String()) != 5+2*tailChanSize*5 {
+		t.Error("Expected all records in output, got", len(tb.buf.String()))
+	}
+}
+
+func TestResetBlocksWrites(t *testing.T) {
+	const records = 20000
+	outs := make([]*testBuffer, 50)
+	for i := range outs {
+		outs[i] = &testBuffer{}
+	}
+
+	// room for all the records, so none is skipped
+	lg := New(LogConfig{Out: outs[0], MaxBufSize: 8 * records, MaxRecordsInBuf: 2 * records, ResetBlocksWrites: true})
+	defer lg.Close()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < records; i++ {
+			lg.Write([]byte(fmt.Sprintf("%06d\n", i)))
+		}
+		close(done)
+	}()
+
+	for _, out := range outs[1:] {
+		lg.Reset(out)
+	}
+	<-done
+	lg.Close()
+
+	var all bytes.Buffer
+	for _, out := range outs {
+		all.Write(out.buf.Bytes())
+	}
+
+	for i := 0; i < records; i++ {
+		line, err := all.ReadString('\n')
+		if err != nil || line != fmt.Sprintf("%06d\n", i) {
+			t.Fatalf("Expected record %06d, got %q", i, line)
+		}
+	}
+	if all.Len() != 0 {
+		t.Error("Expected no extra output, got", all.String())
+	}
+}
+
+func TestHeaderFunc(t *testing.T) {
+	var tb1 testBuffer
+	var tb2 testBuffer
+
+	lg := New(LogConfig{Out: &tb1, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, HeaderFunc: func() []byte { return []byte("header;") }})
+	defer lg.Close()
+	lg.Write([]byte("test1"))
+	lg.Write([]byte("test2"))
+	lg.Reset(&tb2)
+	lg.Write([]byte("test3"))
+	lg.Flush()
+
+	if tb1.buf.String() != "header;test1test2" {
+		t.Error("Expected output = header;test1test2, got", tb1.buf.String())
+	}
+	if tb2.buf.String() != "header;test3" {
+		t.Error("Expected output = header;test3, got", tb2.buf.String())
+	}
+}
+
+func TestInitialBufSize(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, InitialBufSize: 16, MaxBufSize: 64, FlashPeriod: time.Hour,
+		HeaderFunc: func() []byte { return []byte("#") }})
+	defer lg.Close()
+	if n := lg.Stats().MaxBufSize; n != 16 {
+		t.Error("Expected a buffer of 16 bytes, got", n)
+	}
+
+	lg.Write([]byte("0123456789"))
+	lg.Write([]byte("abcdefghij"))
+	if n := lg.Stats().MaxBufSize; n != 32 {
+		t.Error("Expected the buffer to grow to 32 bytes, got", n)
+	}
+	large := strings.Repeat("x", 40)
+	lg.Write([]byte(large))
+	if n, err := lg.Write([]byte(strings.Repeat("y", 64))); n != 0 || err != ErrRecordTooLarge {
+		t.Error("Expected 0, ErrRecordTooLarge, got", n, err)
+	}
+	lg.Flush()
+
+	// Out does not see the switches: one header, nothing skipped but the record larger than MaxBufSize
+	if tb.buf.String() != "#0123456789abcdefghij"+large {
+		t.Error("Expected output = #0123456789abcdefghij"+large+", got", tb.buf.String())
+	}
+	if m := lg.Metrics(); m.TooLargeRecords != 1 || m.SkippedRecords != 0 {
+		t.Error("Expected 1 too large record, got", m)
+	}
+	if c := lg.Config(); c.MaxBufSize != 64 || c.InitialBufSize != 16 || lg.Stats().MaxBufSize != 64 {
+		t.Error("Expected a buffer of 64 bytes, got", c.MaxBufSize, c.InitialBufSize, lg.Stats().MaxBufSize)
+	}
+
+	lg.SetMaxBufSize(16)
+	if c := lg.Config(); c.MaxBufSize != 16 || c.InitialBufSize != 0 {
+		t.Error("Expected a fixed buffer of 16 bytes, got", c.MaxBufSize, c.InitialBufSize)
+	}
+}
+
+func TestSetMaxBufSize(t *testing.T) {
+	var tb testBuffer
+	var skipCount int
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 8, FlashPeriod: time.Hour, SkipHandler: func(n int) { skipCount += n }})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	if err := lg.SetMaxBufSize(32); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if tb.buf.String() != "test1" {
+		t.Error("Expected the old buffer to be written, got", tb.buf.String())
+	}
+	for i := 0; i < 3; i++ {
+		lg.Write([]byte("test2"))
+	}
+	if st := lg.Stats(); st.MaxBufSize != 32 || st.UsedBytes != 15 || skipCount != 0 {
+		t.Errorf("Expected 15 bytes used of 32 without skips, got %+v, %d skipped", st, skipCount)
+	}
+
+	if err := lg.SetMaxBufSize(4); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	lg.Write([]byte("t4"))
+	lg.Write([]byte("test3"))
+	lg.Close()
+	if tb.buf.String() != "test1test2test2test2t4" || lg.Metrics().TooLargeRecords != 1 || skipCount != 0 {
+		t.Error("Expected output = test1test2test2test2t4 with test3 too large, got", tb.buf.String(), lg.Metrics(), skipCount)
+	}
+	if err := lg.SetMaxBufSize(32); err != ErrClosed {
+		t.Error("Expected ErrClosed, got", err)
+	}
+}
+
+func TestChannelCapacity(t *testing.T) {
+	hw := &enteredWriter{hungWriter{release: make(chan struct{})}, make(chan struct{}, 4)}
+	var skipCount int
+	lg := New(LogConfig{Out: hw, MaxBufSize: testBufSize,
+		MaxRecordsInBuf: 1000000,
+		ChannelCapacity: 4,
+		ChunkSize:       1,
+		SkipHandler:     func(n int) { skipCount += n }})
+	defer lg.Close()
+	if c := cap(lg.inputRecords); c != 4 {
+		t.Error("Expected channel capacity = 4, got", c)
+	}
+
+	lg.Write([]byte("a"))
+	<-hw.entered
+	// the background goroutine is writing "a", only 3 records fit into the channel
+	for i := 0; i < 10; i++ {
+		lg.Write([]byte("b"))
+	}
+	if skipCount != 7 {
+		t.Error("Expected skipCount = 7, got", skipCount)
+	}
+
+	close(hw.release)
+	lg.Flush()
+	if hw.buf.String() != "abbb" {
+		t.Error("Expected output = abbb, got", hw.buf.String())
+	}
+}
+
+func TestChannelSlotForReset(t *testing.T) {
+	var tb1, tb2 testBuffer
+	hw := &enteredWriter{hungWriter{release: make(chan struct{})}, make(chan struct{}, 4)}
+	lg := New(LogConfig{Out: &tb1, MaxBufSize: 16, ChannelCapacity: 4, ChunkSize: 1, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	lg.WriteAndWait([]byte("0123456789"))
+	lg.SwapOutput(hw)
+	lg.Write([]byte("a"))
+	<-hw.entered
+	lg.Write([]byte("b"))
+	lg.Write([]byte("c"))
+	// two parts would take the last slot of the channel
+	lg.Write([]byte("defgh"))
+	if m := lg.Metrics(); m.SkippedRecords != 1 {
+		t.Error("Expected the wrapped record to be skipped, got", m)
+	}
+
+	// the switch does not wait for the hung Out to make room in the channel
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := lg.ResetContext(ctx, &tb2); err != context.Canceled {
+		t.Error("Expected context.Canceled, got", err)
+	}
+	close(hw.release)
+	lg.Close()
+	if hw.buf.String() != "abc" {
+		t.Error("Expected output = abc, got", hw.buf.String())
+	}
+}
+
+func TestResetWithFullChannel(t *testing.T) {
+	var tb testBuffer
+	hw := &enteredWriter{hungWriter{release: make(chan struct{})}, make(chan struct{}, 4)}
+	lg := New(LogConfig{Out: hw, MaxBufSize: 64, ChannelCapacity: 3, ChunkSize: 1, FlashPeriod: time.Hour})
+
+	lg.Write([]byte("a"))
+	<-hw.entered
+	lg.Write([]byte("b"))
+	lg.Write([]byte("c"))
+	// the part of Flush takes the slot left by the writes
+	flushed := make(chan error)
+	go func() { flushed <- lg.Flush() }()
+	for lg.Stats().QueuedRecords < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	reset := make(chan struct{})
+	go func() {
+		lg.Reset(&tb)
+		close(reset)
+	}()
+	// the write of a frees its space once the hung Out returns
+	time.Sleep(10 * time.Millisecond)
+	close(hw.release)
+	select {
+	case <-reset:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Reset to return")
+	}
+	<-flushed
+	lg.Write([]byte("d"))
+	lg.Close()
+	if hw.buf.String() != "abc" || tb.buf.String() != "d" {
+		t.Errorf("Expected outputs abc and d, got %q and %q", hw.buf.String(), tb.buf.String())
+	}
+}
+
+func TestSetMaxRecordsInBuf(t *testing.T) {
+	const records = 20000
+	var skipCount int
+
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, MaxRecordsInBuf: 10, SkipHandler: func(n int) { skipCount += n }})
+	defer lg.Close()
+
+	if err := lg.SetMaxRecordsInBuf(0); err == nil {
+		t.Error("Expected error for zero MaxRecordsInBuf")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < records; i++ {
+			lg.Write([]byte(fmt.Sprintf("%06d\n", i)))
+		}
+		close(done)
+	}()
+
+	for _, n := range []int{1000, 5, 100000, 50, 100000} {
+		if err := lg.SetMaxRecordsInBuf(n); err != nil {
+			t.Error("Expected nil error, got", err)
+		}
+		testSleep(5)
+	}
+	<-done
+	lg.Close()
+
+	var count int
+	last := -1
+	for {
+		line, err := tb.buf.ReadString('\n')
+		if err != nil {
+			break
+		}
+		var i int
+		fmt.Sscanf(line, "%d", &i)
+		if i <= last {
+			t.Fatalf("Expected records in order, got %d after %d", i, last)
+		}
+		last = i
+		count++
+	}
+
+	if count+skipCount != records {
+		t.Errorf("Expected %d records written or skipped, got %d + %d", records, count, skipCount)
+	}
+}
+
+func TestMinFlashPeriod(t *testing.T) {
+	var tb testBuffer
+	for _, period := range []time.Duration{time.Nanosecond, time.Microsecond} {
+		lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: period})
+		defer lg.Close()
+		if lg.flashPeriod != minFlashPeriod {
+			t.Error("Expected flashPeriod =", minFlashPeriod, "got", lg.flashPeriod)
+		}
+	}
+
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	defer lg.Close()
+	if lg.flashPeriod != defaultFlashPeriod {
+		t.Error("Expected flashPeriod =", defaultFlashPeriod, "got", lg.flashPeriod)
+	}
+}
+
+func TestTinyFlashPeriodIdle(t *testing.T) {
+	var tb testBuffer
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := &fakeClock{now: start, tick: make(chan time.Time)}
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Nanosecond, clock: clk})
+	defer lg.Close()
+
+	// a tick with nothing buffered writes nothing; the send of each tick waits for ioHandler to take it,
+	// so it handles one tick at a time and no more than it is given
+	for i := 1; i <= 100; i++ {
+		clk.tick <- start.Add(time.Duration(i) * time.Millisecond)
+	}
+	// the ticker runs at most once a millisecond, whatever FlashPeriod asks for
+	if d := clk.tickerPeriod(); d != minFlashPeriod {
+		t.Error("Expected a ticker of", minFlashPeriod, "got", d)
+	}
+	lg.Write([]byte("test1"))
+	for i := 101; i <= 200; i++ {
+		clk.tick <- start.Add(time.Duration(i) * time.Millisecond)
+	}
+	lg.Close()
+	if tb.calls != 1 || tb.buf.String() != "test1" {
+		t.Error("Expected a single write of test1, got", tb.calls, tb.buf.String())
+	}
+}
+
+func TestBoundaryFlushOnly(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: 10 * time.Millisecond, BoundaryFlushOnly: true})
+	defer lg.Close()
+
+	for i := 0; i < 20; i++ {
+		lg.Write([]byte("abcde"))
+		lg.Write([]byte("fghij"))
+		// the next records start further around the buffer, so some of them wrap
+		lg.Flush()
+	}
+
+	if tb.buf.Len() != 200 {
+		t.Error("Expected output length = 200, got", tb.buf.Len())
+	}
+	if n := lg.Stats().WrappedRecords; n == 0 {
+		t.Error("Expected wrapped records")
+	}
+	for _, chunk := range tb.chunks {
+		if len(chunk)%5 != 0 {
+			t.Fatal("Expected whole records in every write, got", chunk)
+		}
+	}
+}
+
+func TestAtomicRecords(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour, AtomicRecords: true})
+	defer lg.Close()
+
+	records := []string{"abc", "defgh", "ijklmnopqr", "xyz"}
+	for i, r := range records {
+		lg.Write([]byte(r))
+		if i == 1 {
+			// the next record wraps around the buffer end
+			lg.Flush()
+		}
+	}
+	lg.Flush()
+
+	if len(tb.chunks) != len(records) {
+		t.Fatal("Expected one write per record, got", tb.chunks)
+	}
+	for i, chunk := range tb.chunks {
+		if chunk != records[i] {
+			t.Error("Expected write =", records[i], "got", chunk)
+		}
+	}
+}
+
+func TestLineBuffered(t *testing.T) {
+	var tb testBuffer
+	clk := &fakeClock{tick: make(chan time.Time)}
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, LineBuffered: true, clock: clk})
+	defer lg.Close()
+
+	lg.Write([]byte("line1\nparti"))
+	if !tickUntilWritten(lg, clk) || tb.buf.String() != "line1\n" {
+		t.Error("Expected output = line1\\n, got", tb.buf.String())
+	}
+	lg.Write([]byte("al\n"))
+	if !tickUntilWritten(lg, clk) || tb.buf.String() != "line1\npartial\n" {
+		t.Error("Expected output = line1\\npartial\\n, got", tb.buf.String())
+	}
+
+	lg.Write([]byte("test1"))
+	tickUntilWritten(lg, clk)
+	clk.set(clk.Now().Add(2 * time.Second))
+	// the second tick returns when the first one is handled
+	clk.tick <- clk.Now()
+	clk.tick <- clk.Now()
+	if tb.buf.String() != "line1\npartial\ntest1" {
+		t.Error("Expected the partial line after MaxLineDelay, got", tb.buf.String())
+	}
+
+	lg.Write([]byte("test2"))
+	tickUntilWritten(lg, clk)
+	lg.Flush()
+	if tb.buf.String() != "line1\npartial\ntest1test2" {
+		t.Error("Expected the partial line after Flush, got", tb.buf.String())
+	}
+}
+
+func TestRecordPrefixSuffix(t *testing.T) {
+	var tb testBuffer
+	var skipCount int
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:   16,
+		FlashPeriod:  time.Hour,
+		RecordPrefix: []byte("["),
+		RecordSuffix: []byte("]\n"),
+		SkipHandler:  func(n int) { skipCount += n }})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	// 8 more bytes do not fit into the 15 free ones
+	lg.Write([]byte("test2"))
+	lg.Flush()
+	lg.WriteString("t3")
+
+	lg.Flush()
+	if tb.buf.String() != "[test1]\n[t3]\n" {
+		t.Error("Expected output = [test1]\\n[t3]\\n, got", tb.buf.String())
+	}
+	if skipCount != 1 {
+		t.Error("Expected skipCount = 1, got", skipCount)
+	}
+}
+
+func TestTimestampFormat(t *testing.T) {
+	var tb testBuffer
+	clk := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC), tick: make(chan time.Time)}
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity,
+		FlashPeriod:     time.Hour,
+		TimestampFormat: time.RFC3339,
+		RecordPrefix:    []byte("["),
+		LineEnding:      LineEndingLF,
+		clock:           clk})
+	defer lg.Close()
+	lg.Write([]byte("test1\n"))
+	lg.WriteKeyed([]byte("k"), "")
+	lg.Flush()
+	if expected := "[2024-01-02T03:04:05Z test1\n\x00\x01k"; tb.buf.String() != expected {
+		t.Errorf("Expected output = %q, got %q", expected, tb.buf.String())
+	}
+
+	tb.buf.Reset()
+	lg = New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour, TimestampFormat: TimestampUnixNano, clock: clk})
+	defer lg.Close()
+	lg.Write([]byte("test2"))
+	lg.Flush()
+	if expected := "1704164645000000006 test2"; tb.buf.String() != expected {
+		t.Error("Expected output =", expected, "got", tb.buf.String())
+	}
+}
+
+func TestSkipHandlerBytes(t *testing.T) {
+	var tb testBuffer
+	var lost []string
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:       8,
+		FlashPeriod:      time.Hour,
+		RecordSuffix:     []byte("\n"),
+		SkipHandlerBytes: func(record []byte) { lost = append(lost, string(record)) }})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	lg.Write([]byte("test2"))
+	lg.WriteContext(context.Background(), make([]byte, 8))
+	if len(lost) != 2 || lost[0] != "test2\n" || len(lost[1]) != 9 {
+		t.Error("Expected lost records test2\\n and 9 zero bytes, got", lost)
+	}
+}
+
+func TestWriteAndWait(t *testing.T) {
+	var tb testBuffer
+	tb.delay = 30 * time.Millisecond
+	lg := New(LogConfig{Out: logwritertest.NewLimitedWriter(&tb, 20), ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	if err := lg.WriteAndWait([]byte("test2")); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if tb.buf.String() != "test1test2" {
+		t.Error("Expected output = test1test2, got", tb.buf.String())
+	}
+
+	// wraps around the buffer end
+	if err := lg.WriteAndWait([]byte("test3test4")); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if tb.buf.String() != "test1test2test3test4" {
+		t.Error("Expected output = test1test2test3test4, got", tb.buf.String())
+	}
+
+	if err := lg.WriteAndWait([]byte("test5")); err == nil {
+		t.Error("Expected write error")
+	}
+
+	if err := lg.WriteAndWait([]byte("test6test7test8test9")); err != ErrRecordTooLarge {
+		t.Error("Expected ErrRecordTooLarge, got", err)
+	}
+}
+
+func TestLineEnding(t *testing.T) {
+	records := []string{"test1\n", "test2\r\n", "test3", "\n", "test4\r"}
+	expected := map[LineEnding]string{
+		LineEndingKeep: "test1\ntest2\r\ntest3\ntest4\r",
+		LineEndingLF:   "test1\ntest2\ntest3\n\ntest4\r\n",
+		LineEndingCRLF: "test1\r\ntest2\r\ntest3\r\n\r\ntest4\r\r\n",
+		LineEndingNone: "test1test2test3test4\r",
+	}
+
+	for ending, output := range expected {
+		var tb testBuffer
+		lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, LineEnding: ending})
+		defer lg.Close()
+		for _, r := range records {
+			lg.WriteAndWait([]byte(r))
+		}
+
+		if tb.buf.String() != output {
+			t.Errorf("LineEnding %d: expected output = %q, got %q", ending, output, tb.buf.String())
+		}
+	}
+}
+
+func TestWriteAllocs(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	defer lg.Close()
+	line := []byte("test")
+
+	if allocs := testing.AllocsPerRun(1000, func() { lg.Write(line) }); allocs != 0 {
+		t.Error("Expected 0 allocs per Write, got", allocs)
+	}
+}
+
+func TestWriteRecords(t *testing.T) {
+	var tb testBuffer
+	var skipCount int
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:  16,
+		FlashPeriod: time.Hour,
+		SkipHandler: func(n int) { skipCount += n }})
+	defer lg.Close()
+
+	records := [][]byte{[]byte("test1"), nil, []byte("test2"), []byte("test3"), []byte("test4"), []byte("test5")}
+	if n, err := lg.WriteRecords(records); n != 4 || err != ErrDropped {
+		t.Error("Expected 4 records and ErrDropped, got", n, err)
+	}
+	if skipCount != 2 {
+		t.Error("Expected skipCount = 2, got", skipCount)
+	}
+	lg.Flush()
+	if tb.buf.String() != "test1test2test3" {
+		t.Error("Expected output = test1test2test3, got", tb.buf.String())
+	}
+
+	lg = New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, OverflowPolicy: OverflowBlock})
+	defer lg.Close()
+	tb.buf.Reset()
+	records = [][]byte{[]byte("test6"), []byte("0123456789abcdef"), []byte("test7")}
+	if n, err := lg.WriteRecords(records); n != 1 || err != ErrRecordTooLarge {
+		t.Error("Expected 1 record and ErrRecordTooLarge, got", n, err)
+	}
+	lg.Close()
+	if n, err := lg.WriteRecords(records); n != 0 || err != ErrClosed {
+		t.Error("Expected 0 records and ErrClosed, got", n, err)
+	}
+	if tb.buf.String() != "test6" {
+		t.Error("Expected output = test6, got", tb.buf.String())
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, AtomicRecords: true, LineEnding: LineEndingCRLF})
+	defer lg.Close()
+
+	n, err := lg.ReadFrom(iotest.OneByteReader(strings.NewReader("line1\nline2\nline3")))
+	if n != 17 || err != nil {
+		t.Error("Expected 17, nil, got", n, err)
+	}
+	lg.Flush()
+	expected := []string{"line1\n", "line2\n", "line3"}
+	if fmt.Sprint(tb.chunks) != fmt.Sprint(expected) {
+		t.Error("Expected writes", expected, "got", tb.chunks)
+	}
+
+	tb = testBuffer{delay: 100 * time.Millisecond}
+	lg = New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 8})
+	defer lg.Close()
+	// the first chunk of 7 bytes fills the buffer, the second one is skipped
+	n, err = lg.ReadFrom(strings.NewReader(strings.Repeat("a", 20)))
+	if n != 14 || err != ErrDropped {
+		t.Error("Expected 14, ErrDropped, got", n, err)
+	}
+	lg.Close()
+	if tb.buf.String() != "aaaaaaa" {
+		t.Error("Expected output = aaaaaaa, got", tb.buf.String())
+	}
+}
+
+func TestTryWrite(t *testing.T) {
+	var tb testBuffer
+	var reasons []SkipReason
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity,
+		FlashPeriod:       time.Hour,
+		SkipReasonHandler: func(n int, reason SkipReason) { reasons = append(reasons, reason) }})
+	defer lg.Close()
+
+	if !lg.TryWrite([]byte("test1")) {
+		t.Error("Expected TryWrite to buffer the record")
+	}
+	// another writer holds the buffer
+	lg.muInput.Lock()
+	if lg.TryWrite([]byte("test2")) {
+		t.Error("Expected TryWrite to skip the record")
+	}
+	lg.muInput.Unlock()
+	lg.TryWrite([]byte("test3"))
+
+	lg.Flush()
+	if tb.buf.String() != "test1test3" {
+		t.Error("Expected output = test1test3, got", tb.buf.String())
+	}
+	if len(reasons) != 1 || reasons[0] != SkippedBusy {
+		t.Error("Expected reasons = [SkippedBusy], got", reasons)
+	}
+	if m := lg.Metrics(); m.BusyRecords != 1 || m.SkippedRecords != 0 {
+		t.Error("Expected BusyRecords = 1, got", m)
+	}
+
+	lg.Close()
+	if lg.TryWrite([]byte("test4")) {
+		t.Error("Expected TryWrite to fail after Close")
+	}
+}
+
+func TestWriteString(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, LineEnding: LineEndingLF})
+	defer lg.Close()
+
+	if n, err := lg.WriteString("test1"); n != 5 || err != nil {
+		t.Error("Expected 5, nil, got", n, err)
+	}
+	lg.WriteString("")
+	lg.Flush()
+	if tb.buf.String() != "test1\n" {
+		t.Error("Expected output = test1\\n, got", tb.buf.String())
+	}
+
+	line := "test"
+	if allocs := testing.AllocsPerRun(1000, func() { lg.WriteString(line) }); allocs != 0 {
+		t.Error("Expected 0 allocs per WriteString, got", allocs)
+	}
+}
+
+func TestWriteStringSkipHandlerBytes(t *testing.T) {
+	var tb testBuffer
+	var skipped []string
+	lg := New(LogConfig{Out: &tb, MaxBufSize: 4, ChannelCapacity: testChannelCapacity,
+		SkipHandlerBytes: func(record []byte) {
+			// the handler owns the record; it must not be the memory of the string
+			record[0] = 'T'
+			skipped = append(skipped, string(record))
+		}})
+	defer lg.Close()
+
+	s := "test1"
+	lg.WriteString(s)
+	if s != "test1" {
+		t.Error("Expected the string to stay test1, got", s)
+	}
+	if len(skipped) != 1 || skipped[0] != "Test1" {
+		t.Error("Expected skipped [Test1], got", skipped)
+	}
+}
+
+func TestSwapOutput(t *testing.T) {
+	var tb1 testBuffer
+	var tb2 testBuffer
+	out1 := logwritertest.NewLimitedWriter(&tb1, 10)
+	lg := New(LogConfig{Out: out1, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour})
+	defer lg.Close()
+	buf := lg.buf
+
+	lg.Write([]byte("test1"))
+	lg.Write([]byte("test2"))
+	if err := lg.SwapOutput(&tb2); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if tb1.buf.String() != "test1test2" {
+		t.Error("Expected output = test1test2, got", tb1.buf.String())
+	}
+
+	// wraps around the buffer end
+	lg.Write([]byte("test3test4"))
+	if err := lg.SwapOutput(out1); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if tb2.buf.String() != "test3test4" {
+		t.Error("Expected output = test3test4, got", tb2.buf.String())
+	}
+	if lg.buf != buf {
+		t.Error("Expected the buffer to be kept")
+	}
+
+	lg.Write([]byte("test5"))
+	if err := lg.SwapOutput(&tb2); err == nil {
+		t.Error("Expected write error")
+	}
+	if err := lg.SwapOutput(nil); err == nil {
+		t.Error("Expected error for nil Out")
+	}
+}
+
+func TestOccupancyHistogram(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 100, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	lg.WriteAndWait(make([]byte, 95))
+	lg.WriteAndWait(make([]byte, 4))
+	lg.WriteAndWait(make([]byte, 55))
+
+	// the last record wraps around the buffer end and is written in two chunks
+	expected := []int{1, 0, 0, 0, 0, 2, 0, 0, 0, 1}
+	if h := lg.OccupancyHistogram(); fmt.Sprint(h) != fmt.Sprint(expected) {
+		t.Error("Expected histogram =", expected, "got", h)
+	}
+}
+
+func benchmarkSteadyLoad(b *testing.B, deferFlush bool) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb,
+		MaxBufSize:          100 * b.N,
+		MaxRecordsInBuf:     5000000,
+		FlashPeriod:         time.Millisecond,
+		DeferFlushWhileBusy: deferFlush})
+	defer lg.Close()
+	line := make([]byte, 100)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lg.Write(line)
+		if i%100 == 0 {
+			time.Sleep(100 * time.Microsecond)
+		}
+	}
+	lg.WriteAndWait(line)
+	b.ReportMetric(float64(tb.calls)/float64(b.N), "writes/op")
+}
+
+func BenchmarkSteadyLoad(b *testing.B) {
+	benchmarkSteadyLoad(b, false)
+}
+
+func BenchmarkSteadyLoadDeferFlush(b *testing.B) {
+	benchmarkSteadyLoad(b, true)
+}
+
+func TestDeferFlushWhileBusy(t *testing.T) {
+	var tb testBuffer
+	clk := &fakeClock{tick: make(chan time.Time)}
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, DeferFlushWhileBusy: true, clock: clk})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	if !tickUntilWritten(lg, clk) || tb.buf.String() != "test1" {
+		t.Error("Expected idle flush, got", tb.buf.String())
+	}
+}
+
+func TestFlushOnIdle(t *testing.T) {
+	var tb testBuffer
+	written := make(chan int, 10)
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour, FlushOnIdle: true,
+		PostWriteHandler: func(out io.Writer, n int) { written <- n }})
+	defer lg.Close()
+
+	for i := 0; i < 10; i++ {
+		lg.Write([]byte("test1"))
+	}
+	// written long before FlashPeriod
+	for total := 0; total < 50; {
+		select {
+		case n := <-written:
+			total += n
+		case <-time.After(time.Second):
+			t.Fatal("Expected output length = 50, got", total)
+		}
+	}
+	if tb.buf.Len() != 50 {
+		t.Error("Expected output length = 50, got", tb.buf.Len())
+	}
+}
+
+func TestMaxFlushChunkSize(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour, MaxFlushChunkSize: 100})
+	defer lg.Close()
+
+	for i := 0; i < 20; i++ {
+		lg.Write([]byte("test1test2test3test4test5test6"))
+	}
+	lg.Flush()
+
+	if tb.buf.Len() != 600 {
+		t.Error("Expected output length = 600, got", tb.buf.Len())
+	}
+	if len(tb.chunks) != 7 {
+		t.Error("Expected 7 writes, got", len(tb.chunks))
+	}
+	for _, chunk := range tb.chunks {
+		if len(chunk) > 100 || len(chunk)%30 != 0 {
+			t.Error("Expected whole records up to 100 bytes, got", len(chunk))
+		}
+	}
+}
+
+func TestInternalLogger(t *testing.T) {
+	var messages []string
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:       8,
+		FlashPeriod:      time.Hour,
+		CircuitThreshold: 2,
+		InternalLogger:   func(msg string) { messages = append(messages, msg) }})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	lg.Write([]byte("test2"))
+	lg.Write([]byte("test3"))
+	lg.Flush()
+	tb.panicbit = true
+	lg.WriteAndWait([]byte("test4"))
+	lg.WriteAndWait([]byte("test5"))
+
+	expected := []string{
+		"logwriter: buffer is full, skipping records",
+		"logwriter: Out panicked: write error",
+		"logwriter: 2 consecutive write errors, pausing writes for 1s: logwriter: Out panicked: write error",
+	}
+	if fmt.Sprint(messages) != fmt.Sprint(expected) {
+		t.Errorf("Expected messages %q, got %q", expected, messages)
+	}
+}
+
+func TestMigrateTo(t *testing.T) {
+	var tb1 testBuffer
+	var tb2 testBuffer
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := &fakeClock{now: start, tick: make(chan time.Time)}
+	lg := New(LogConfig{Out: &tb1, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, clock: clk})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	if err := lg.MigrateTo(&tb2, 150*time.Millisecond); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	lg.Write([]byte("test2"))
+	lg.Flush()
+	if tb1.buf.String() != "test1test2" || tb2.buf.String() != "test2" {
+		t.Error("Expected both outputs during migration, got", tb1.buf.String(), tb2.buf.String())
+	}
+
+	// the next record ends the window
+	clk.set(start.Add(150 * time.Millisecond))
+	lg.Write([]byte("test3"))
+	lg.Flush()
+	if tb1.buf.String() != "test1test2" || tb2.buf.String() != "test2test3" {
+		t.Error("Expected only the new output after migration, got", tb1.buf.String(), tb2.buf.String())
+	}
+}
+
+// hungWriter blocks every write until release is closed.
+type hungWriter struct {
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *hungWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	hw := &hungWriter{release: make(chan struct{})}
+	lg := New(LogConfig{Out: hw, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, ChunkSize: 1})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	lg.Write([]byte("test2"))
+	lg.Write([]byte("test3"))
+	if err := lg.CloseWithTimeout(50 * time.Millisecond); err != ErrCloseTimeout {
+		t.Error("Expected ErrCloseTimeout, got", err)
+	}
+
+	// the write in progress finishes, the rest is abandoned
+	close(hw.release)
+	select {
+	case <-lg.done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected ioHandler to stop")
+	}
+	if hw.buf.String() != "test1" {
+		t.Error("Expected output = test1, got", hw.buf.String())
+	}
+
+	var tb testBuffer
+	lg = New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	defer lg.Close()
+	lg.Write([]byte("test4"))
+	if err := lg.CloseWithTimeout(time.Second); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	select {
+	case <-lg.done:
+	default:
+		t.Error("Expected ioHandler to be stopped when CloseWithTimeout returns")
+	}
+	if tb.buf.String() != "test4" {
+		t.Error("Expected output = test4, got", tb.buf.String())
+	}
+	if err := lg.CloseWithTimeout(time.Second); err != nil {
+		t.Error("Expected nil error for a closed LogWriter, got", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	hw := &hungWriter{release: make(chan struct{})}
+	var mu sync.Mutex
+	var errs []error
+	lg := New(LogConfig{Out: hw, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, ChunkSize: 1, WriteTimeout: 50 * time.Millisecond,
+		WriteErrorHandlerErr: func(out io.Writer, err error) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	testSleep(100)
+	// the first write still hangs, the second one is not started
+	lg.Write([]byte("test2"))
+	testSleep(20)
+
+	close(hw.release)
+	testSleep(20)
+	lg.Write([]byte("test3"))
+	lg.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 2 || errs[0] != ErrWriteTimeout || errs[1] != ErrWriteTimeout {
+		t.Error("Expected 2 ErrWriteTimeout, got", errs)
+	}
+	// the timed out write completes late
+	if hw.buf.String() != "test1test3" {
+		t.Error("Expected output = test1test3, got", hw.buf.String())
+	}
+}
+
+func TestClose(t *testing.T) {
+	var tb testBuffer
+	tb.delay = 10 * time.Millisecond
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	for i := 0; i < 10; i++ {
+		lg.Write([]byte("test1"))
+	}
+
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { errs <- lg.Close() }()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Error("Expected nil error, got", err)
+		}
+	}
+
+	if tb.buf.Len() != 50 {
+		t.Error("Expected output length = 50, got", tb.buf.Len())
+	}
+	select {
+	case <-lg.done:
+	default:
+		t.Error("Expected ioHandler to be stopped")
+	}
+	if lg.buf != nil {
+		t.Error("Expected the buffer to be released")
+	}
+
+	if n, err := lg.Write([]byte("test2")); n != 0 || err != ErrClosed {
+		t.Error("Expected 0, ErrClosed, got", n, err)
+	}
+	if err := lg.WriteAndWait([]byte("test2")); err != ErrClosed {
+		t.Error("Expected ErrClosed, got", err)
+	}
+	if err := lg.SwapOutput(&tb); err != ErrClosed {
+		t.Error("Expected ErrClosed, got", err)
+	}
+	lg.Reset(&tb)
+	if err := lg.Close(); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	start := time.Now()
+	if err := lg.Flush(); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Error("Expected empty Flush to return at once, got", d)
+	}
+
+	for i := 0; i < 10; i++ {
+		lg.Write([]byte("test1"))
+	}
+	if err := lg.Flush(); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if tb.buf.Len() != 50 {
+		t.Error("Expected output length = 50, got", tb.buf.Len())
+	}
+
+	lg.Close()
+	if err := lg.Flush(); err != ErrClosed {
+		t.Error("Expected ErrClosed, got", err)
+	}
+}
+
+func TestFlushAndWait(t *testing.T) {
+	var tb1, tb2 testBuffer
+	tb1.delay = 30 * time.Millisecond
+	tb2.delay = 30 * time.Millisecond
+	lg := New(LogConfig{Out: &tb1, Outs: []io.Writer{&tb2}, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	lg.Write([]byte("test2"))
+	if err := lg.FlushAndWait(); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	// the slow writes are over by the time FlushAndWait returns
+	if tb1.buf.String() != "test1test2" || tb2.buf.String() != "test1test2" {
+		t.Error("Expected output = test1test2 in both Outs, got", tb1.buf.String(), tb2.buf.String())
+	}
+
+	lg.Close()
+	if err := lg.FlushAndWait(); err != ErrClosed {
+		t.Error("Expected ErrClosed, got", err)
+	}
+
+	// Flush reports the failed writes to the Outs as well
+	lg = New(LogConfig{Out: &tb1, Outs: []io.Writer{logwritertest.NewLimitedWriter(&tb2, 0)},
+		MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour})
+	defer lg.Close()
+	lg.Write([]byte("test3"))
+	if err := lg.Flush(); !errors.Is(err, logwritertest.ErrLimit) {
+		t.Error("Expected ErrLimit of the Out, got", err)
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour, ChunkSize: 10})
+	defer lg.Close()
+
+	for i := 0; i < 5; i++ {
+		lg.Write([]byte("test1"))
+	}
+	// the last record waits for Flush
+	lg.Flush()
+	if fmt.Sprint(tb.chunks) != "[test1test1 test1test1 test1]" {
+		t.Error("Expected chunks of 10 bytes, got", tb.chunks)
+	}
+
+	lg2 := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	defer lg2.Close()
+	if lg2.chunkSize != defaultChunkSize {
+		t.Error("Expected chunkSize =", defaultChunkSize, "got", lg2.chunkSize)
+	}
+	lg3 := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 100, ChunkSize: 200})
+	defer lg3.Close()
+	if lg3.chunkSize != 100 {
+		t.Error("Expected chunkSize = 100, got", lg3.chunkSize)
+	}
+}
+
+func TestNewWithError(t *testing.T) {
+	out := &testBuffer{}
+	for _, config := range []LogConfig{
+		{},
+		{Out: out, Outs: []io.Writer{nil}},
+		{Out: out, MaxBufSize: -1},
+		{Out: out, MaxRecordsInBuf: -1},
+		{Out: out, ChannelCapacity: -1},
+		{Out: out, FlashPeriod: -time.Second},
+		{Out: out, RotateAt: []string{"25:00"}},
+	} {
+		if l, err := NewWithError(config); !errors.Is(err, ErrInvalidConfig) || l != nil {
+			t.Errorf("Expected ErrInvalidConfig for %+v, got %v", config, err)
+		}
+	}
+
+	l, err := NewWithError(LogConfig{Out: out, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	l.Close()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic for nil Out")
+		}
+	}()
+	New(LogConfig{})
+}
+
+func TestFlushSignal(t *testing.T) {
+	var tb testBuffer
+	signal := make(chan struct{})
+	written := make(chan int, 1)
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour, FlushSignal: signal,
+		PostWriteHandler: func(out io.Writer, n int) { written <- n }})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	select {
+	case n := <-written:
+		t.Error("Expected no write before the signal, got", n)
+	case <-time.After(20 * time.Millisecond):
+	}
+	signal <- struct{}{}
+	<-written
+	if tb.buf.String() != "test1" {
+		t.Error("Expected output = test1, got", tb.buf.String())
+	}
+
+	// a closed signal does not spin or block the records
+	close(signal)
+	lg.Write([]byte("test2"))
+	if err := lg.Flush(); err != nil || tb.buf.String() != "test1test2" {
+		t.Error("Expected output = test1test2, got", tb.buf.String(), err)
+	}
+	lg.Close()
+}
+
+func TestFlushOnEmptyWrite(t *testing.T) {
+	for _, flushOnEmpty := range []bool{false, true} {
+		var tb testBuffer
+		written := make(chan int, 1)
+		lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour, FlushOnEmptyWrite: flushOnEmpty,
+			PostWriteHandler: func(out io.Writer, n int) { written <- n }})
+		defer lg.Close()
+
+		lg.Write([]byte("test1"))
+		if n, err := lg.Write(nil); n != 0 || err != nil {
+			t.Error("Expected 0, nil, got", n, err)
+		}
+		select {
+		case n := <-written:
+			if !flushOnEmpty || n != 5 {
+				t.Error("Expected no write, got", n)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if flushOnEmpty {
+				t.Error("Expected a write after the empty Write")
+			}
+		}
+		lg.Close()
+	}
+}
+
+func TestConcurrentOrder(t *testing.T) {
+	const writers, records = 8, 2000
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 1 << 16, ChunkSize: 256, OverflowPolicy: OverflowBlock})
+	defer lg.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				fmt.Fprintf(lg, "%d %d\n", g, i)
+			}
+		}(g)
+	}
+	wg.Wait()
+	lg.Close()
+
+	next := make([]int, writers)
+	for {
+		line, err := tb.buf.ReadString('\n')
+		if err != nil {
+			break
+		}
+		var g, i int
+		if _, err := fmt.Sscanf(line, "%d %d", &g, &i); err != nil || g < 0 || g >= writers {
+			t.Fatalf("Expected a record, got %q", line)
+		}
+		if i != next[g] {
+			t.Fatalf("Expected record %d of writer %d, got %d", next[g], g, i)
+		}
+		next[g]++
+	}
+	for g, n := range next {
+		if n != records {
+			t.Errorf("Expected %d records of writer %d, got %d", records, g, n)
+		}
+	}
+}
+
+// tickerCountClock counts the tickers made by a fakeClock and the running ones.
+type tickerCountClock struct {
+	*fakeClock
+	tickers atomic.Int32
+	running atomic.Int32
+}
+
+func (c *tickerCountClock) NewTicker(d time.Duration) ticker {
+	c.tickers.Add(1)
+	c.running.Add(1)
+	return countedTicker{c.fakeClock.NewTicker(d), c}
+}
+
+type countedTicker struct {
+	ticker
+	c *tickerCountClock
+}
+
+func (t countedTicker) Stop() {
+	t.c.running.Add(-1)
+	t.ticker.Stop()
+}
+
+func TestImmediateFlush(t *testing.T) {
+	var tb testBuffer
+	written := make(chan int, 2)
+	clk := &tickerCountClock{fakeClock: &fakeClock{}}
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, ImmediateFlush: true, clock: clk,
+		PostWriteHandler: func(out io.Writer, n int) { written <- n }})
+	defer lg.Close()
+
+	// the ticker never fires, every record is written at once
+	lg.Write([]byte("test1"))
+	<-written
+	lg.Write([]byte("test2"))
+	<-written
+	if tb.buf.String() != "test1test2" || len(tb.chunks) != 2 {
+		t.Error("Expected 2 writes of test1test2, got", tb.chunks)
+	}
+	if n := clk.tickers.Load(); n != 0 {
+		t.Error("Expected no ticker, got", n)
+	}
+	lg.Close()
+}
+
+func TestConfig(t *testing.T) {
+	var tb1, tb2 testBuffer
+	lg := New(LogConfig{Out: &tb1, ChannelCapacity: testChannelCapacity, MaxBufSize: 1024, ChunkSize: 4096})
+	defer lg.Close()
+
+	c := lg.Config()
+	if c.Out != &tb1 || c.MaxBufSize != 1024 || c.MaxRecordsInBuf != defaultMaxRecordsInBuf ||
+		c.FlashPeriod != defaultFlashPeriod || c.ChunkSize != 1024 || c.MaxLineDelay != defaultMaxLineDelay {
+		t.Errorf("Expected the defaults, got %+v", c)
+	}
+
+	lg.Reset(&tb2)
+	lg.SetMaxBufSize(2048)
+	lg.SetMaxRecordsInBuf(10)
+	if c = lg.Config(); c.Out != &tb2 || c.MaxBufSize != 2048 || c.MaxRecordsInBuf != 10 {
+		t.Errorf("Expected the current Out and sizes, got %+v", c)
+	}
+	lg.Close()
+}
+
+func TestOutBufferSize(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, ChunkSize: 1, FlashPeriod: time.Hour, OutBufferSize: 64})
+	defer lg.Close()
+
+	for i := 0; i < 10; i++ {
+		lg.Write([]byte("test1"))
+	}
+	lg.Flush()
+	for i := 0; i < 15; i++ {
+		lg.Write([]byte("test2"))
+	}
+	lg.Close()
+
+	// the records are collected into writes of up to 64 bytes, the rest is written by Close
+	expected := []string{strings.Repeat("test1", 10), strings.Repeat("test2", 12), strings.Repeat("test2", 3)}
+	if !slices.Equal(tb.chunks, expected) {
+		t.Error("Expected writes", expected, "got", tb.chunks)
+	}
+}
+
+func TestAdaptiveFlush(t *testing.T) {
+	var tb testBuffer
+	clk := &tickerCountClock{fakeClock: &fakeClock{tick: make(chan time.Time)}}
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, AdaptiveFlush: true, clock: clk})
+	defer lg.Close()
+
+	running := func(expected int32) bool {
+		for i := 0; i < 100; i++ {
+			if clk.running.Load() == expected {
+				return true
+			}
+			testSleep(5)
+		}
+		return false
+	}
+
+	if !running(0) {
+		t.Error("Expected no ticker while idle, got", clk.running.Load())
+	}
+	lg.Write([]byte("test1"))
+	if !running(1) {
+		t.Error("Expected the ticker to start with a record, got", clk.running.Load())
+	}
+	clk.tick <- clk.Now()
+	if !running(0) {
+		t.Error("Expected the ticker to stop once the buffer is written, got", clk.running.Load())
+	}
+	if tb.buf.String() != "test1" {
+		t.Error("Expected output = test1, got", tb.buf.String())
+	}
+	lg.Write([]byte("test2"))
+	if !running(1) {
+		t.Error("Expected the ticker to start again, got", clk.running.Load())
+	}
+	lg.Close()
+	if !running(0) {
+		t.Error("Expected the ticker stopped after Close, got", clk.running.Load())
+	}
+}
+
+// periodClock reports the period of every ticker made by a fakeClock.
+type periodClock struct {
+	*fakeClock
+	periods chan time.Duration
+}
+
+func (c *periodClock) NewTicker(d time.Duration) ticker {
+	c.periods <- d
+	return c.fakeClock.NewTicker(d)
+}
+
+func TestResetConfig(t *testing.T) {
+	var tb1, tb2 testBuffer
+	clk := &periodClock{fakeClock: &fakeClock{}, periods: make(chan time.Duration, 2)}
+	lg := New(LogConfig{Out: &tb1, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour, clock: clk})
+	defer lg.Close()
+	if d := <-clk.periods; d != time.Hour {
+		t.Error("Expected period = 1h, got", d)
+	}
+
+	lg.Write([]byte("test1"))
+	if err := lg.ResetConfig(LogConfig{Out: &tb2, MaxBufSize: 32, MaxRecordsInBuf: 4, FlashPeriod: time.Minute}); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if d := <-clk.periods; d != time.Minute {
+		t.Error("Expected period = 1m, got", d)
+	}
+	lg.Write([]byte("test2"))
+	lg.Flush()
+
+	if tb1.buf.String() != "test1" || tb2.buf.String() != "test2" {
+		t.Error("Expected output = test1, test2, got", tb1.buf.String(), tb2.buf.String())
+	}
+	if c := lg.Config(); c.Out != &tb2 || c.MaxBufSize != 32 || c.MaxRecordsInBuf != 4 || c.FlashPeriod != time.Minute {
+		t.Error("Expected the new config, got", c)
+	}
+	if s := lg.Stats(); s.MaxBufSize != 32 {
+		t.Error("Expected buffer of 32 bytes, got", s.MaxBufSize)
+	}
+
+	if err := lg.ResetConfig(LogConfig{MaxBufSize: 32}); !errors.Is(err, ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig, got", err)
+	}
+	lg.Close()
+	if err := lg.ResetConfig(LogConfig{Out: &tb1}); err != ErrClosed {
+		t.Error("Expected ErrClosed, got", err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour})
+	defer lg.Close()
+	buf := lg.buf
+
+	lg.Write([]byte("test1"))
+	lg.Write([]byte("test2"))
+	if err := lg.Truncate(); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	// without Truncate the record would wrap at the end of the buffer
+	lg.Write([]byte("0123456789abc"))
+	lg.Flush()
+
+	if tb.buf.String() != "test1test20123456789abc" {
+		t.Error("Expected output = test1test20123456789abc, got", tb.buf.String())
+	}
+	if s := lg.Stats(); s.WrappedRecords != 0 || s.UsedBytes != 0 {
+		t.Error("Expected an empty buffer and no wrapped records, got", s)
+	}
+	if lg.buf != buf {
+		t.Error("Expected the buffer to be reused")
+	}
+
+	lg.Close()
+	if err := lg.Truncate(); err != ErrClosed {
+		t.Error("Expected ErrClosed, got", err)
+	}
+}
+
+func TestFlushJitter(t *testing.T) {
+	var tb testBuffer
+	clk := &fakeClock{after: make(chan time.Time), waiting: make(chan time.Duration)}
+	written := make(chan struct{}, 1)
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: 100 * time.Millisecond, FlushJitter: 0.1, clock: clk,
+		PostWriteHandler: func(io.Writer, int) { written <- struct{}{} }})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	periods := map[time.Duration]bool{}
+	for i := 0; i < 10; i++ {
+		d := <-clk.waiting
+		if d < 90*time.Millisecond || d > 110*time.Millisecond {
+			t.Error("Expected a period of 100ms ±10%, got", d)
+		}
+		periods[d] = true
+		clk.after <- clk.Now()
+	}
+	// the ticks the busy ioHandler is not ready for are dropped, so tick until the record is written
+	for flushed := false; !flushed; {
+		select {
+		case <-written:
+			flushed = true
+		case <-clk.waiting:
+			clk.after <- clk.Now()
+		}
+	}
+	if len(periods) < 2 {
+		t.Error("Expected random periods, got", periods)
+	}
+	if tb.buf.String() != "test1" {
+		t.Error("Expected output = test1, got", tb.buf.String())
+	}
+
+	if _, err := NewWithError(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlushJitter: 1}); !errors.Is(err, ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig, got", err)
+	}
+	go func() {
+		for range clk.waiting {
+		}
+	}()
+	lg.Close()
+}
+
+func TestFlushRecordCount(t *testing.T) {
+	var tb testBuffer
+	written := make(chan int, 3)
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour, FlushRecordCount: 3,
+		PostWriteHandler: func(out io.Writer, n int) { written <- n }})
+	defer lg.Close()
+
+	for i := 1; i <= 5; i++ {
+		lg.Write([]byte("test" + strconv.Itoa(i)))
+	}
+	if n := <-written; n != 15 {
+		t.Error("Expected a write of 3 records, got", n)
+	}
+	// the count starts again after the write
+	lg.Write([]byte("test6"))
+	if n := <-written; n != 15 {
+		t.Error("Expected a write of 3 records, got", n)
+	}
+	lg.Write([]byte("test7"))
+	lg.Flush()
+	if !slices.Equal(tb.chunks, []string{"test1test2test3", "test4test5test6", "test7"}) {
+		t.Error("Expected 3 writes, got", tb.chunks)
+	}
+
+	if _, err := NewWithError(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlushRecordCount: -1}); !errors.Is(err, ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig, got", err)
+	}
+}
@@ -0,0 +1,59 @@
+// Package logwriterprom exports the counters of a logwriter.LogWriter to Prometheus.
+// It is a separate package, so that logwriter itself does not depend on the Prometheus client.
+package logwriterprom
+
+import (
+	"github.com/oleg-safonov/logwriter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector implements prometheus.Collector for a LogWriter.
+// The metrics have the names of LogWriter.WritePrometheusMetrics and, if LogConfig.Name is set, the label name="<Name>",
+// so LogWriters with different Names can share a registry. LogWriters without a Name need a registry each,
+// or a registerer wrapped with labels.
+type Collector struct {
+	lw *logwriter.LogWriter
+
+	records     *prometheus.Desc
+	skipped     *prometheus.Desc
+	writeErrors *prometheus.Desc
+	buffered    *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewPrometheusCollector returns a Collector that reads the metrics of lw on every scrape.
+func NewPrometheusCollector(lw *logwriter.LogWriter) *Collector {
+	var labels prometheus.Labels
+	if name := lw.Metrics().Name; name != "" {
+		labels = prometheus.Labels{"name": name}
+	}
+	return &Collector{
+		lw: lw,
+		records: prometheus.NewDesc("logwriter_records_total",
+			"Records accepted into the buffer.", nil, labels),
+		skipped: prometheus.NewDesc("logwriter_skipped_total",
+			"Records lost because the buffer was full.", nil, labels),
+		writeErrors: prometheus.NewDesc("logwriter_write_errors_total",
+			"Failed writes to Out.", nil, labels),
+		buffered: prometheus.NewDesc("logwriter_buffered_bytes",
+			"Bytes buffered and not yet written to Out.", nil, labels),
+	}
+}
+
+// Describe sends the descriptors of the metrics of the Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.records
+	ch <- c.skipped
+	ch <- c.writeErrors
+	ch <- c.buffered
+}
+
+// Collect sends the current values of the metrics.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	m := c.lw.Metrics()
+	ch <- prometheus.MustNewConstMetric(c.records, prometheus.CounterValue, float64(m.Records))
+	ch <- prometheus.MustNewConstMetric(c.skipped, prometheus.CounterValue, float64(m.SkippedRecords))
+	ch <- prometheus.MustNewConstMetric(c.writeErrors, prometheus.CounterValue, float64(m.WriteErrors))
+	ch <- prometheus.MustNewConstMetric(c.buffered, prometheus.GaugeValue, float64(c.lw.Len()))
+}
@@ -0,0 +1,55 @@
+package logwriterprom
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/oleg-safonov/logwriter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+	var out bytes.Buffer
+	lw := logwriter.New(logwriter.LogConfig{Out: &out, MaxBufSize: 1 << 10, ChannelCapacity: 16, Name: "audit"})
+	defer lw.Close()
+	c := NewPrometheusCollector(lw)
+
+	descs := make(chan *prometheus.Desc, 10)
+	c.Describe(descs)
+	if len(descs) != 4 {
+		t.Error("Expected 4 descriptors, got", len(descs))
+	}
+
+	metrics := make(chan prometheus.Metric, 10)
+	c.Collect(metrics)
+	if len(metrics) != 4 {
+		t.Error("Expected 4 metrics, got", len(metrics))
+	}
+	close(metrics)
+	for m := range metrics {
+		if d := m.Desc().String(); !strings.Contains(d, `name="audit"`) {
+			t.Error("Expected the label of Name, got", d)
+		}
+	}
+
+	// LogWriters with different Names share a registry
+	lw2 := logwriter.New(logwriter.LogConfig{Out: &out, MaxBufSize: 1 << 10, ChannelCapacity: 16, Name: "access"})
+	defer lw2.Close()
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if err := reg.Register(NewPrometheusCollector(lw2)); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal("Expected nil error, got", err)
+	}
+	for _, f := range families {
+		if f.GetName() == "logwriter_buffered_bytes" && len(f.GetMetric()) != 2 {
+			t.Error("Expected logwriter_buffered_bytes of both LogWriters, got", f.GetMetric())
+		}
+	}
+}
@@ -0,0 +1,21 @@
+module github.com/oleg-safonov/logwriter/logwriterprom
+
+go 1.22
+
+require (
+	github.com/oleg-safonov/logwriter v0.0.0-20261018064528-12bfd48a3e3f
+	github.com/prometheus/client_golang v1.19.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	google.golang.org/protobuf v1.32.0 // indirect
+)
+
+// the parent module of this repository while developing; users get the version required above
+replace github.com/oleg-safonov/logwriter => ../
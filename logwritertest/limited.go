@@ -0,0 +1,42 @@
+// Package logwritertest provides outputs for testing code that uses logwriter,
+// for example its handling of write errors.
+package logwritertest
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrLimit is returned by LimitedWriter once its limit is reached.
+var ErrLimit = errors.New("logwritertest: write limit reached")
+
+// LimitedWriter writes to W but fails once N bytes have been written, like a full disk or an exhausted quota.
+// Each write decreases N by the number of bytes written; raising N again lets writes succeed.
+// A write that does not fit writes the bytes that fit and returns ErrLimit.
+// LimitedWriter is not safe for concurrent use.
+type LimitedWriter struct {
+	W io.Writer // underlying writer
+	N int64     // max bytes remaining
+}
+
+// NewLimitedWriter returns a LimitedWriter that writes at most limit bytes to w.
+func NewLimitedWriter(w io.Writer, limit int64) *LimitedWriter {
+	return &LimitedWriter{W: w, N: limit}
+}
+
+func (l *LimitedWriter) Write(p []byte) (n int, err error) {
+	if l.N <= 0 {
+		return 0, ErrLimit
+	}
+
+	fits := p
+	if int64(len(fits)) > l.N {
+		fits = fits[:l.N]
+	}
+	n, err = l.W.Write(fits)
+	l.N -= int64(n)
+	if err == nil && n < len(p) {
+		err = ErrLimit
+	}
+	return n, err
+}
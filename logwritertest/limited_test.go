@@ -0,0 +1,29 @@
+package logwritertest
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLimitedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewLimitedWriter(&buf, 7)
+
+	if n, err := w.Write([]byte("test1")); n != 5 || err != nil {
+		t.Error("Expected 5, nil, got", n, err)
+	}
+	if n, err := w.Write([]byte("test2")); n != 2 || err != ErrLimit {
+		t.Error("Expected 2, ErrLimit, got", n, err)
+	}
+	if n, err := w.Write([]byte("test3")); n != 0 || err != ErrLimit {
+		t.Error("Expected 0, ErrLimit, got", n, err)
+	}
+
+	w.N = 5
+	if n, err := w.Write([]byte("test4")); n != 5 || err != nil {
+		t.Error("Expected 5, nil, got", n, err)
+	}
+	if buf.String() != "test1tetest4" {
+		t.Error("Expected output = test1tetest4, got", buf.String())
+	}
+}
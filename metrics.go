@@ -0,0 +1,129 @@
+package logwriter
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+)
+
+// Metrics holds cumulative counters of a LogWriter since it was created.
+type Metrics struct {
+	Name                  string // LogConfig.Name
+	Records               uint64 // records accepted into the buffer
+	Bytes                 uint64 // bytes of the accepted records
+	SkippedRecords        uint64 // records lost because the buffer was full: SkippedNewest and DroppedOldest
+	TooLargeRecords       uint64 // records skipped because they were larger than the whole buffer: SkippedTooLarge
+	BusyRecords           uint64 // records skipped by TryWrite because another writer was using the buffer: SkippedBusy
+	WriteErrors           uint64 // failed writes to Out
+	BytesWritten          uint64 // bytes written to Out successfully, see BytesWritten
+	SpilledRecords        uint64 // records written to OverflowWriter because the buffer was full
+	SampledRecords        uint64 // records dropped by SamplingRate
+	OversizeRecords       uint64 // records dropped because they were longer than MaxRecordSize
+	LevelDroppedRecords   uint64 // records dropped by a LeveledWriter because their level was below its minimum
+	CircuitDroppedRecords uint64 // records discarded instead of being written to Out while the circuit was open: DroppedCircuitOpen
+	CircuitDroppedBytes   uint64 // bytes of CircuitDroppedRecords
+}
+
+// metrics are the counters behind Metrics, updated without locks.
+type metrics struct {
+	totalRecords          atomic.Uint64
+	totalBytes            atomic.Uint64
+	skippedRecords        atomic.Uint64
+	tooLargeRecords       atomic.Uint64
+	busyRecords           atomic.Uint64
+	writeErrors           atomic.Uint64
+	bytesWritten          atomic.Uint64
+	spilledRecords        atomic.Uint64
+	sampledRecords        atomic.Uint64
+	oversizeRecords       atomic.Uint64
+	levelDroppedRecords   atomic.Uint64
+	circuitDroppedRecords atomic.Uint64
+	circuitDroppedBytes   atomic.Uint64
+}
+
+// Metrics returns a snapshot of the counters. The handlers, if set, are still called; the counters work without them.
+func (l *LogWriter) Metrics() Metrics {
+	return Metrics{
+		Name:                  l.name,
+		Records:               l.metrics.totalRecords.Load(),
+		Bytes:                 l.metrics.totalBytes.Load(),
+		SkippedRecords:        l.metrics.skippedRecords.Load(),
+		TooLargeRecords:       l.metrics.tooLargeRecords.Load(),
+		BusyRecords:           l.metrics.busyRecords.Load(),
+		WriteErrors:           l.metrics.writeErrors.Load(),
+		BytesWritten:          l.metrics.bytesWritten.Load(),
+		SpilledRecords:        l.metrics.spilledRecords.Load(),
+		SampledRecords:        l.metrics.sampledRecords.Load(),
+		OversizeRecords:       l.metrics.oversizeRecords.Load(),
+		LevelDroppedRecords:   l.metrics.levelDroppedRecords.Load(),
+		CircuitDroppedRecords: l.metrics.circuitDroppedRecords.Load(),
+		CircuitDroppedBytes:   l.metrics.circuitDroppedBytes.Load(),
+	}
+}
+
+// BytesWritten returns the number of bytes written to Out successfully since the LogWriter was created,
+// including headers and the part of a write that failed after a short write. It counts every Out that LogWriter has written to.
+func (l *LogWriter) BytesWritten() uint64 {
+	return l.metrics.bytesWritten.Load()
+}
+
+// WritePrometheusMetrics writes the counters of Metrics and the state of Stats to w in the Prometheus text exposition format,
+// for a /metrics handler of a service that does not use the Prometheus client. If LogConfig.Name is set,
+// the samples have the label name="<Name>". The metric names are stable:
+//
+//	logwriter_records_total                counter  records accepted into the buffer
+//	logwriter_bytes_total                  counter  bytes of the accepted records
+//	logwriter_skipped_total                counter  records lost because the buffer was full
+//	logwriter_too_large_total              counter  records larger than the whole buffer
+//	logwriter_busy_total                   counter  records skipped by TryWrite because the buffer was busy
+//	logwriter_write_errors_total           counter  failed writes to Out
+//	logwriter_written_bytes_total          counter  bytes written to Out successfully
+//	logwriter_spilled_total                counter  records written to OverflowWriter
+//	logwriter_sampled_total                counter  records dropped by SamplingRate
+//	logwriter_oversize_total               counter  records longer than MaxRecordSize
+//	logwriter_level_dropped_total          counter  records dropped by a LeveledWriter
+//	logwriter_circuit_dropped_total        counter  records discarded while the circuit was open
+//	logwriter_circuit_dropped_bytes_total  counter  bytes discarded while the circuit was open
+//	logwriter_wrapped_total                counter  records split at the end of the buffer
+//	logwriter_buffered_bytes               gauge    bytes buffered and not yet written to Out
+//	logwriter_buffer_size_bytes            gauge    size of the buffer
+//	logwriter_high_water_mark_bytes        gauge    largest logwriter_buffered_bytes
+//	logwriter_skipping                     gauge    1 while new records are being skipped
+func (l *LogWriter) WritePrometheusMetrics(w io.Writer) error {
+	m := l.Metrics()
+	s := l.Stats()
+	skipping := 0
+	if s.Skipping {
+		skipping = 1
+	}
+
+	labels := ""
+	if m.Name != "" {
+		labels = "{name=" + strconv.Quote(m.Name) + "}"
+	}
+	var b []byte
+	add := func(name, typ, help string, v uint64) {
+		b = fmt.Appendf(b, "# HELP %s %s\n# TYPE %s %s\n%s%s %d\n", name, help, name, typ, name, labels, v)
+	}
+	add("logwriter_records_total", "counter", "Records accepted into the buffer.", m.Records)
+	add("logwriter_bytes_total", "counter", "Bytes of the records accepted into the buffer.", m.Bytes)
+	add("logwriter_skipped_total", "counter", "Records lost because the buffer was full.", m.SkippedRecords)
+	add("logwriter_too_large_total", "counter", "Records skipped because they were larger than the whole buffer.", m.TooLargeRecords)
+	add("logwriter_busy_total", "counter", "Records skipped by TryWrite because another writer was using the buffer.", m.BusyRecords)
+	add("logwriter_write_errors_total", "counter", "Failed writes to Out.", m.WriteErrors)
+	add("logwriter_written_bytes_total", "counter", "Bytes written to Out successfully.", m.BytesWritten)
+	add("logwriter_spilled_total", "counter", "Records written to OverflowWriter because the buffer was full.", m.SpilledRecords)
+	add("logwriter_sampled_total", "counter", "Records dropped by SamplingRate.", m.SampledRecords)
+	add("logwriter_oversize_total", "counter", "Records dropped because they were longer than MaxRecordSize.", m.OversizeRecords)
+	add("logwriter_level_dropped_total", "counter", "Records dropped by a LeveledWriter because of their level.", m.LevelDroppedRecords)
+	add("logwriter_circuit_dropped_total", "counter", "Records discarded while the circuit was open.", m.CircuitDroppedRecords)
+	add("logwriter_circuit_dropped_bytes_total", "counter", "Bytes discarded while the circuit was open.", m.CircuitDroppedBytes)
+	add("logwriter_wrapped_total", "counter", "Records split in two parts at the end of the buffer.", s.WrappedRecords)
+	add("logwriter_buffered_bytes", "gauge", "Bytes buffered and not yet written to Out.", uint64(s.UsedBytes))
+	add("logwriter_buffer_size_bytes", "gauge", "Size of the buffer.", uint64(s.MaxBufSize))
+	add("logwriter_high_water_mark_bytes", "gauge", "Largest number of bytes buffered at once.", uint64(s.HighWaterMark))
+	add("logwriter_skipping", "gauge", "1 while new records are being skipped.", uint64(skipping))
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,251 @@
+package logwriter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oleg-safonov/logwriter/logwritertest"
+)
+
+func TestMetrics(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: logwritertest.NewLimitedWriter(&tb, 5), ChannelCapacity: testChannelCapacity, MaxBufSize: 8, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	lg.Write([]byte("test2"))
+	lg.Flush()
+	lg.WriteAndWait([]byte("t3"))
+
+	expected := Metrics{Records: 2, Bytes: 7, SkippedRecords: 1, WriteErrors: 1, BytesWritten: 5}
+	if m := lg.Metrics(); m != expected {
+		t.Errorf("Expected %+v, got %+v", expected, m)
+	}
+	if n := lg.BytesWritten(); n != 5 {
+		t.Error("Expected BytesWritten = 5, got", n)
+	}
+}
+
+func TestOverflowWriter(t *testing.T) {
+	var tb, spill testBuffer
+	tb.delay = 100 * time.Millisecond
+	var skipCount int
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:     16,
+		OverflowWriter: &spill,
+		SkipHandler:    func(n int) { skipCount += n }})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	lg.Write([]byte("test2"))
+	lg.Write([]byte("test3"))
+	// the buffer is full
+	lg.Write([]byte("test4"))
+	if err := lg.WriteAndWait([]byte("0123456789abcdef")); err != nil {
+		t.Error("Expected nil error, got", err)
+	}
+	if n, err := lg.WriteRecords([][]byte{[]byte("test5"), []byte("test6")}); n != 2 || err != nil {
+		t.Error("Expected 2, nil, got", n, err)
+	}
+	lg.Close()
+
+	if tb.buf.String() != "test1test2test3" {
+		t.Error("Expected output = test1test2test3, got", tb.buf.String())
+	}
+	if spill.buf.String() != "test40123456789abcdeftest5test6" {
+		t.Error("Expected spilled = test40123456789abcdeftest5test6, got", spill.buf.String())
+	}
+	if m := lg.Metrics(); m.SpilledRecords != 4 || m.SkippedRecords != 0 || skipCount != 0 {
+		t.Error("Expected 4 spilled and no skipped records, got", m, skipCount)
+	}
+}
+
+func TestName(t *testing.T) {
+	type event struct {
+		name string
+		n    int
+	}
+	var events []event
+	onSkip := func(name string, n int, reason SkipReason) { events = append(events, event{name, n}) }
+
+	var tb1, tb2, tb3 testBuffer
+	lg1 := New(LogConfig{Out: &tb1, ChannelCapacity: testChannelCapacity, MaxBufSize: 8, FlashPeriod: time.Hour, Name: "access", NamedSkipHandler: onSkip})
+	defer lg1.Close()
+	lg2 := New(LogConfig{Out: &tb2, ChannelCapacity: testChannelCapacity, MaxBufSize: 8, FlashPeriod: time.Hour, Name: "audit", NamedSkipHandler: onSkip,
+		Outs: []io.Writer{&tb3}, ExpvarPrefix: "testnamed"})
+	defer lg2.Close()
+
+	lg1.Write([]byte("test1"))
+	lg1.Write([]byte("test2"))
+	lg2.Write([]byte("test3"))
+	lg2.Write([]byte("test4"))
+	lg2.Flush()
+	if v := expvarCounter("testnamed.audit", "records"); v != uint64(1) {
+		t.Error("Expected testnamed.audit records = 1, got", v)
+	}
+	lg1.Close()
+	lg2.Close()
+
+	// the sink of lg2 skips its copy of test4 too
+	expected := []event{{"access", 1}, {"audit/1", 1}, {"audit", 1}}
+	if !slices.Equal(events, expected) {
+		t.Error("Expected events", expected, "got", events)
+	}
+	if m := lg2.Metrics(); m.Name != "audit" || m.SkippedRecords != 1 {
+		t.Error("Expected the metrics of audit, got", m)
+	}
+}
+
+func TestMaxRecordSize(t *testing.T) {
+	var tb testBuffer
+	var oversized []int
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, MaxRecordSize: 5, OversizeHandler: func(n int) { oversized = append(oversized, n) }})
+	defer lg.Close()
+
+	if n, err := lg.Write([]byte("test1")); n != 5 || err != nil {
+		t.Error("Expected 5, nil, got", n, err)
+	}
+	if n, err := lg.Write([]byte("test22")); n != 0 || err != ErrRecordOversize {
+		t.Error("Expected 0, ErrRecordOversize, got", n, err)
+	}
+	if !errors.Is(lg.WriteAndWait([]byte("test333")), ErrDropped) {
+		t.Error("Expected ErrRecordOversize to wrap ErrDropped")
+	}
+	// the oversized record is not counted, the one after it is accepted
+	if n, err := lg.WriteRecords([][]byte{[]byte("test4"), []byte("test4444"), []byte("test5")}); n != 2 || err != ErrRecordOversize {
+		t.Error("Expected 2, ErrRecordOversize, got", n, err)
+	}
+	lg.Close()
+
+	if tb.buf.String() != "test1test4test5" {
+		t.Error("Expected output = test1test4test5, got", tb.buf.String())
+	}
+	if !slices.Equal(oversized, []int{6, 7, 8}) {
+		t.Error("Expected oversized [6 7 8], got", oversized)
+	}
+	if m := lg.Metrics(); m.OversizeRecords != 3 || m.SkippedRecords != 0 {
+		t.Error("Expected 3 oversize and no skipped records, got", m)
+	}
+}
+
+func TestWritePrometheusMetrics(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, Name: "app"})
+	defer lg.Close()
+
+	lg.WriteAndWait([]byte("test1"))
+	var out bytes.Buffer
+	if err := lg.WritePrometheusMetrics(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE logwriter_records_total counter\n",
+		"logwriter_records_total{name=\"app\"} 1\n",
+		"logwriter_bytes_total{name=\"app\"} 5\n",
+		"logwriter_skipped_total{name=\"app\"} 0\n",
+		"# TYPE logwriter_buffered_bytes gauge\n",
+		"logwriter_buffered_bytes{name=\"app\"} 0\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected %q in the output, got\n%s", line, out.String())
+		}
+	}
+}
+
+// dropCounters are the counters of the reasons a record is lost for.
+type dropCounters struct {
+	skipped, tooLarge, busy, circuitDropped uint64
+}
+
+// checkDrops checks the drop counters of lg and that SkipHandler got only the records lost because the buffer was full.
+func checkDrops(t *testing.T, lg *LogWriter, skipCount int, reasons []SkipReason, expected dropCounters, reason SkipReason) {
+	t.Helper()
+	m := lg.Metrics()
+	if got := (dropCounters{m.SkippedRecords, m.TooLargeRecords, m.BusyRecords, m.CircuitDroppedRecords}); got != expected {
+		t.Errorf("Expected %+v, got %+v", expected, got)
+	}
+	if skipCount != int(expected.skipped) {
+		t.Errorf("Expected SkipHandler to get %d records, got %d", expected.skipped, skipCount)
+	}
+	if !slices.Equal(reasons, []SkipReason{reason}) {
+		t.Error("Expected reasons", []SkipReason{reason}, "got", reasons)
+	}
+}
+
+func TestDropsSkippedNewest(t *testing.T) {
+	var skipCount int
+	var reasons []SkipReason
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour,
+		SkipHandler:       func(n int) { skipCount += n },
+		SkipReasonHandler: func(n int, reason SkipReason) { reasons = append(reasons, reason) }})
+	defer lg.Close()
+
+	lg.Write([]byte("0123456789"))
+	lg.Write([]byte("abcdefghij"))
+	checkDrops(t, lg, skipCount, reasons, dropCounters{skipped: 1}, SkippedNewest)
+}
+
+func TestDropsDroppedOldest(t *testing.T) {
+	var skipCount int
+	var reasons []SkipReason
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour,
+		OverflowPolicy:    OverflowDropOldest,
+		SkipHandler:       func(n int) { skipCount += n },
+		SkipReasonHandler: func(n int, reason SkipReason) { reasons = append(reasons, reason) }})
+	defer lg.Close()
+
+	lg.Write([]byte("0123456789"))
+	lg.Write([]byte("abcdefghij"))
+	checkDrops(t, lg, skipCount, reasons, dropCounters{skipped: 1}, DroppedOldest)
+}
+
+func TestDropsSkippedTooLarge(t *testing.T) {
+	var skipCount int
+	var reasons []SkipReason
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour,
+		SkipHandler:       func(n int) { skipCount += n },
+		SkipReasonHandler: func(n int, reason SkipReason) { reasons = append(reasons, reason) }})
+	defer lg.Close()
+
+	lg.Write(make([]byte, 16))
+	checkDrops(t, lg, skipCount, reasons, dropCounters{tooLarge: 1}, SkippedTooLarge)
+}
+
+func TestDropsSkippedBusy(t *testing.T) {
+	var skipCount int
+	var reasons []SkipReason
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour,
+		SkipHandler:       func(n int) { skipCount += n },
+		SkipReasonHandler: func(n int, reason SkipReason) { reasons = append(reasons, reason) }})
+	defer lg.Close()
+
+	lg.muInput.Lock()
+	lg.TryWrite([]byte("test1"))
+	lg.muInput.Unlock()
+	checkDrops(t, lg, skipCount, reasons, dropCounters{busy: 1}, SkippedBusy)
+}
+
+func TestDropsDroppedCircuitOpen(t *testing.T) {
+	var skipCount int
+	var reasons []SkipReason
+	var tb testBuffer
+	lg := New(LogConfig{Out: logwritertest.NewLimitedWriter(&tb, 0), ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour,
+		CircuitThreshold:  1,
+		CircuitCooldown:   time.Hour,
+		SkipHandler:       func(n int) { skipCount += n },
+		SkipReasonHandler: func(n int, reason SkipReason) { reasons = append(reasons, reason) }})
+	defer lg.Close()
+
+	lg.WriteAndWait([]byte("test1")) // opens the circuit
+	lg.WriteAndWait([]byte("test2"))
+	checkDrops(t, lg, skipCount, reasons, dropCounters{circuitDropped: 1}, DroppedCircuitOpen)
+}
@@ -0,0 +1,29 @@
+package logwriter
+
+import "sync/atomic"
+
+// OccupancyBuckets is the number of buckets of OccupancyHistogram.
+const OccupancyBuckets = 10
+
+// OccupancyHistogram returns how many times the buffer was found at each level of fullness.
+// The buffer is sampled every time a chunk is written to Out, just before the chunk's space is freed.
+// Bucket i counts samples with used bytes in [i*MaxBufSize/10, (i+1)*MaxBufSize/10),
+// so bucket 0 is under 10% full and bucket 9 is 90% full or more.
+// Comparing the upper buckets with the total shows how often the buffer comes close to overflowing.
+func (l *LogWriter) OccupancyHistogram() []int {
+	h := make([]int, OccupancyBuckets)
+	for i := range h {
+		h[i] = int(atomic.LoadUint64(&l.occupancy[i]))
+	}
+	return h
+}
+
+// sampleOccupancy must be called under muInternal.
+func (l *LogWriter) sampleOccupancy() {
+	used := l.maxBufSize - 1 - l.freeSize()
+	i := used * OccupancyBuckets / l.maxBufSize
+	if i >= OccupancyBuckets {
+		i = OccupancyBuckets - 1
+	}
+	atomic.AddUint64(&l.occupancy[i], 1)
+}
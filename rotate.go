@@ -0,0 +1,111 @@
+package logwriter
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+type timeOfDay struct {
+	hour, min, sec int
+}
+
+func parseTimesOfDay(times []string) ([]timeOfDay, error) {
+	tods := make([]timeOfDay, 0, len(times))
+	for _, s := range times {
+		t, err := time.Parse("15:04:05", s)
+		if err != nil {
+			t, err = time.Parse("15:04", s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid RotateAt time %q, want 15:04 or 15:04:05", s)
+		}
+		tods = append(tods, timeOfDay{t.Hour(), t.Minute(), t.Second()})
+	}
+	return tods, nil
+}
+
+// mustParseTimesOfDay is parseTimesOfDay for times already checked by LogConfig.validate.
+func mustParseTimesOfDay(times []string) []timeOfDay {
+	tods, err := parseTimesOfDay(times)
+	if err != nil {
+		panic(err)
+	}
+	return tods
+}
+
+// nextRotation returns the first of the times of day strictly after now, in the location of now.
+// Days are stepped by the calendar, not by 24 hours, so DST changes do not shift the schedule.
+// A time that does not exist on a DST day (skipped by the clock change) is moved forward by the change.
+func nextRotation(now time.Time, times []timeOfDay) time.Time {
+	var next time.Time
+	y, m, d := now.Date()
+	for day := 0; day <= 1; day++ {
+		for _, t := range times {
+			c := time.Date(y, m, d+day, t.hour, t.min, t.sec, 0, now.Location())
+			want := time.Date(y, m, d+day, t.hour, t.min, t.sec, 0, time.UTC)
+			got := time.Date(c.Year(), c.Month(), c.Day(), c.Hour(), c.Minute(), c.Second(), 0, time.UTC)
+			if got.Before(want) {
+				// time.Date may resolve a skipped time to before the gap
+				c = c.Add(want.Sub(got))
+			}
+			if c.After(now) && (next.IsZero() || c.Before(next)) {
+				next = c
+			}
+		}
+	}
+	return next
+}
+
+// nextInterval returns the time of the rotation after now for RotateInterval interval.
+// If aligned is set, it is the next multiple of interval in the location of now, otherwise now + interval.
+func nextInterval(now time.Time, interval time.Duration, aligned bool) time.Time {
+	if !aligned {
+		return now.Add(interval)
+	}
+	// Truncate counts from the zero time in UTC, shift now so that it counts in local time
+	_, offset := now.Zone()
+	shift := time.Duration(offset) * time.Second
+	return now.Add(shift).Truncate(interval).Add(interval - shift)
+}
+
+// rotator opens a new file at every scheduled time of day and switches the LogWriter to it with Reset.
+// It stops and closes its file when the LogWriter is closed.
+type rotator struct {
+	l        *LogWriter
+	times    []timeOfDay
+	filename func(time.Time) string
+	clock    clock
+	file     *os.File
+}
+
+func (r *rotator) run() {
+	for {
+		now := r.clock.Now()
+		next := nextRotation(now, r.times)
+		select {
+		case <-r.clock.After(next.Sub(now)):
+		case <-r.l.done:
+			if r.file != nil {
+				r.file.Close()
+			}
+			return
+		}
+		r.rotate(next)
+	}
+}
+
+func (r *rotator) rotate(at time.Time) {
+	f, err := os.OpenFile(r.filename(at), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		// keep writing to the current file, the next rotation tries again
+		r.l.warn(fmt.Sprintf("logwriter: rotation failed: %v", err))
+		return
+	}
+
+	r.l.Reset(f)
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file = f
+}
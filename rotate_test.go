@@ -0,0 +1,175 @@
+package logwriter
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestNextRotation(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	times := mustParseTimesOfDay([]string{"00:00", "02:30", "12:00:30"})
+	tests := []struct {
+		now, next time.Time
+	}{
+		{time.Date(2024, 1, 1, 0, 0, 0, 0, ny), time.Date(2024, 1, 1, 2, 30, 0, 0, ny)},
+		{time.Date(2024, 1, 1, 12, 0, 30, 0, ny), time.Date(2024, 1, 2, 0, 0, 0, 0, ny)},
+		{time.Date(2024, 1, 1, 12, 0, 0, 0, ny), time.Date(2024, 1, 1, 12, 0, 30, 0, ny)},
+		// 02:30 does not exist on the spring-forward day
+		{time.Date(2024, 3, 10, 1, 0, 0, 0, ny), time.Date(2024, 3, 10, 3, 30, 0, 0, ny)},
+		// the fall-back day is 25 hours long, midnight is still midnight
+		{time.Date(2024, 11, 3, 23, 0, 0, 0, ny), time.Date(2024, 11, 4, 0, 0, 0, 0, ny)},
+	}
+
+	for _, tt := range tests {
+		if next := nextRotation(tt.now, times); !next.Equal(tt.next) {
+			t.Errorf("From %v expected %v, got %v", tt.now, tt.next, next)
+		}
+	}
+}
+
+func TestRotator(t *testing.T) {
+	dir := t.TempDir()
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity})
+	defer lg.Close()
+
+	clk := &fakeClock{now: time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC),
+		after:   make(chan time.Time),
+		waiting: make(chan time.Duration, 1)}
+	r := &rotator{l: lg,
+		times:    mustParseTimesOfDay([]string{"00:00"}),
+		filename: func(at time.Time) string { return filepath.Join(dir, at.Format("2006-01-02")+".log") },
+		clock:    clk}
+	go r.run()
+
+	lg.Write([]byte("test1"))
+	if d := <-clk.waiting; d != time.Hour {
+		t.Error("Expected wait = 1h, got", d)
+	}
+	clk.set(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	clk.after <- clk.Now()
+
+	if d := <-clk.waiting; d != 24*time.Hour {
+		t.Error("Expected wait = 24h, got", d)
+	}
+	lg.Write([]byte("test2"))
+	clk.set(time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC))
+	clk.after <- clk.Now()
+	<-clk.waiting
+
+	lg.Write([]byte("test3"))
+	testSleep(200)
+
+	if tb.buf.String() != "test1" {
+		t.Error("Expected output = test1, got", tb.buf.String())
+	}
+	for name, expected := range map[string]string{"2024-01-02.log": "test2", "2024-01-03.log": "test3"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(b) != expected {
+			t.Errorf("Expected %s = %s, got %q %v", name, expected, b, err)
+		}
+	}
+}
+
+func TestInvalidRotateAt(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic for invalid RotateAt")
+		}
+	}()
+	New(LogConfig{Out: &testBuffer{}, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, RotateAt: []string{"25:00"}, RotateFilenameFunc: func(time.Time) string { return "" }})
+}
+
+func TestRotateBytes(t *testing.T) {
+	var tb1, tb2 testBuffer
+	var rotated []io.Writer
+	lg := New(LogConfig{Out: &tb1, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity,
+		FlashPeriod: time.Hour,
+		RotateBytes: 10,
+		RotateHandler: func(out io.Writer) (io.Writer, error) {
+			rotated = append(rotated, out)
+			return &tb2, nil
+		},
+		HeaderFunc: func() []byte { return []byte("#") }})
+	defer lg.Close()
+
+	lg.WriteAndWait([]byte("test1"))
+	lg.WriteAndWait([]byte("test2"))
+	lg.WriteAndWait([]byte("test3"))
+	// the count starts again for the new Out
+	lg.SetMaxBufSize(64)
+	lg.WriteAndWait([]byte("test4"))
+
+	if tb1.buf.String() != "#test1test2" {
+		t.Error("Expected old output = #test1test2, got", tb1.buf.String())
+	}
+	if tb2.buf.String() != "#test3#test4" {
+		t.Error("Expected new output = #test3#test4, got", tb2.buf.String())
+	}
+	if len(rotated) != 1 || rotated[0] != &tb1 {
+		t.Error("Expected one rotation of the old Out, got", rotated)
+	}
+}
+
+func TestNextInterval(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		now      time.Time
+		interval time.Duration
+		aligned  bool
+		next     time.Time
+	}{
+		{time.Date(2024, 1, 1, 10, 20, 0, 0, ny), time.Hour, false, time.Date(2024, 1, 1, 11, 20, 0, 0, ny)},
+		{time.Date(2024, 1, 1, 10, 20, 0, 0, ny), time.Hour, true, time.Date(2024, 1, 1, 11, 0, 0, 0, ny)},
+		{time.Date(2024, 1, 1, 10, 0, 0, 0, ny), time.Hour, true, time.Date(2024, 1, 1, 11, 0, 0, 0, ny)},
+		// daily files start at the local midnight
+		{time.Date(2024, 1, 1, 22, 0, 0, 0, ny), 24 * time.Hour, true, time.Date(2024, 1, 2, 0, 0, 0, 0, ny)},
+	}
+
+	for _, tt := range tests {
+		if next := nextInterval(tt.now, tt.interval, tt.aligned); !next.Equal(tt.next) {
+			t.Errorf("From %v expected %v, got %v", tt.now, tt.next, next)
+		}
+	}
+}
+
+func TestRotateInterval(t *testing.T) {
+	var tb1, tb2 testBuffer
+	start := time.Date(2024, 1, 1, 10, 20, 0, 0, time.UTC)
+	clk := &fakeClock{now: start, tick: make(chan time.Time)}
+	lg := New(LogConfig{Out: &tb1, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity,
+		ChunkSize:      1024,
+		RotateInterval: time.Hour,
+		RotateAligned:  true,
+		RotateHandler:  func(io.Writer) (io.Writer, error) { return &tb2, nil },
+		clock:          clk})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	clk.tick <- start.Add(30 * time.Minute)
+	lg.Write([]byte("test2"))
+	// the rotation is at 11:00
+	clk.tick <- start.Add(40 * time.Minute)
+	lg.Write([]byte("test3"))
+	clk.tick <- start.Add(50 * time.Minute)
+	lg.Flush()
+
+	if tb1.buf.String() != "test1test2" {
+		t.Error("Expected old output = test1test2, got", tb1.buf.String())
+	}
+	if tb2.buf.String() != "test3" {
+		t.Error("Expected new output = test3, got", tb2.buf.String())
+	}
+}
@@ -0,0 +1,86 @@
+package logwriter
+
+import "bytes"
+
+// Stats is a snapshot of the state of the buffer.
+type Stats struct {
+	UsedBytes     int  // bytes buffered and not yet written to Out
+	FreeBytes     int  // bytes available for new records
+	QueuedRecords int  // records (parts of records) queued for the background goroutine
+	MaxBufSize    int  // size of the buffer, which grows up to LogConfig.MaxBufSize from InitialBufSize
+	Skipping      bool // new records are being skipped
+
+	// WrappedRecords counts the records split in two parts at the end of the buffer since the LogWriter was created.
+	// If it grows with most records, the buffer is small for them; a sink that needs whole records
+	// gets them in two writes unless BoundaryFlushOnly or AtomicRecords is set.
+	WrappedRecords uint64
+
+	// HighWaterMark is the largest UsedBytes since the LogWriter was created, with any buffer size it has had.
+	// If it comes close to MaxBufSize, records are at risk of being skipped in bursts and the buffer should be larger.
+	HighWaterMark int
+}
+
+// Stats returns the current state of the buffer. All fields are taken at the same moment.
+func (l *LogWriter) Stats() Stats {
+	l.muInternal.Lock()
+	defer l.muInternal.Unlock()
+
+	free := l.freeSize()
+	return Stats{
+		UsedBytes:     l.maxBufSize - 1 - free,
+		FreeBytes:     free,
+		QueuedRecords: l.queuedLen(),
+		MaxBufSize:    l.maxBufSize,
+		Skipping:      l.skipping,
+
+		WrappedRecords: l.wrapped,
+		HighWaterMark:  l.highWater,
+	}
+}
+
+// Healthy reports whether the LogWriter is keeping up, for example for a readiness probe: it returns false
+// while new records are being skipped, within HealthWindow after a failed write to Out, and after Close.
+func (l *LogWriter) Healthy() bool {
+	now := l.clock.Now()
+	l.muInternal.Lock()
+	defer l.muInternal.Unlock()
+
+	if l.closed || l.skipping {
+		return false
+	}
+	return l.lastError.IsZero() || now.Sub(l.lastError) >= l.healthWindow
+}
+
+// Len returns the number of bytes buffered and not yet written to Out, like UsedBytes of Stats, but cheaper.
+func (l *LogWriter) Len() int {
+	l.muInternal.Lock()
+	defer l.muInternal.Unlock()
+
+	if l.startPos <= l.endPos {
+		return l.endPos - l.startPos
+	}
+	// the used region wraps around the end of the buffer
+	return l.maxBufSize - l.startPos + l.endPos
+}
+
+// Snapshot returns a copy of the bytes in the buffer that have not been written to Out yet, oldest first,
+// for example to dump them to stderr from a recover handler before the process exits.
+// The bytes of the write to Out in progress are included, as it may not finish. Snapshot waits for a Write in progress,
+// so that the records are whole. It returns nil after Close.
+func (l *LogWriter) Snapshot() []byte {
+	l.muInput.Lock()
+	defer l.muInput.Unlock()
+	l.muInternal.Lock()
+	defer l.muInternal.Unlock()
+
+	if l.buf == nil || l.startPos == l.endPos {
+		return nil
+	}
+	if l.startPos < l.endPos {
+		return bytes.Clone((*l.buf)[l.startPos:l.endPos])
+	}
+	// the used region wraps around the end of the buffer
+	b := make([]byte, 0, l.maxBufSize-l.startPos+l.endPos)
+	b = append(b, (*l.buf)[l.startPos:]...)
+	return append(b, (*l.buf)[:l.endPos]...)
+}
@@ -0,0 +1,218 @@
+package logwriter
+
+import (
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	var tb testBuffer
+	tb.delay = 100 * time.Millisecond
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: 10 * time.Millisecond})
+	defer lg.Close()
+
+	expected := Stats{UsedBytes: 0, FreeBytes: 15, MaxBufSize: 16}
+	if st := lg.Stats(); st != expected {
+		t.Errorf("Expected %+v, got %+v", expected, st)
+	}
+
+	lg.Write([]byte("test1"))
+	lg.Write([]byte("test2"))
+	testSleep(50)
+	lg.Write([]byte("test3"))
+	lg.Write([]byte("test4"))
+
+	expected = Stats{UsedBytes: 15, FreeBytes: 0, QueuedRecords: 1, MaxBufSize: 16, Skipping: true, HighWaterMark: 15}
+	if st := lg.Stats(); st != expected {
+		t.Errorf("Expected %+v, got %+v", expected, st)
+	}
+
+	testSleep(300)
+	expected = Stats{UsedBytes: 0, FreeBytes: 15, MaxBufSize: 16, HighWaterMark: 15}
+	if st := lg.Stats(); st != expected {
+		t.Errorf("Expected %+v, got %+v", expected, st)
+	}
+}
+
+func TestOnBackpressure(t *testing.T) {
+	var tb testBuffer
+	tb.delay = 100 * time.Millisecond
+	states := make(chan bool, 4)
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity,
+		MaxBufSize:     16,
+		FlashPeriod:    10 * time.Millisecond,
+		OnBackpressure: func(active bool) { states <- active }})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	lg.Write([]byte("test2"))
+	testSleep(50)
+	lg.Write([]byte("test3"))
+	lg.Write([]byte("test4"))
+	lg.Write([]byte("test5"))
+
+	testSleep(300)
+	lg.Close()
+	close(states)
+	var got []bool
+	for active := range states {
+		got = append(got, active)
+	}
+	if len(got) != 2 || !got[0] || got[1] {
+		t.Error("Expected states = [true false], got", got)
+	}
+}
+
+func TestLen(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	lg.Write([]byte("0123456789"))
+	if n := lg.Len(); n != 10 {
+		t.Error("Expected Len = 10, got", n)
+	}
+	lg.Flush()
+	if n := lg.Len(); n != 0 {
+		t.Error("Expected Len = 0, got", n)
+	}
+
+	lg.Write([]byte("abcdefgh")) // wraps around the buffer end
+	if n := lg.Len(); n != 8 {
+		t.Error("Expected Len = 8, got", n)
+	}
+	lg.Flush()
+	if n := lg.Len(); n != 0 {
+		t.Error("Expected Len = 0, got", n)
+	}
+}
+
+func TestWrappedRecords(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	lg.Write([]byte("0123456789"))
+	lg.Flush()
+	lg.Write([]byte("abcdefgh")) // wraps around the buffer end
+	lg.Write([]byte("ijk"))
+	if n := lg.Stats().WrappedRecords; n != 1 {
+		t.Error("Expected WrappedRecords = 1, got", n)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	if b := lg.Snapshot(); b != nil {
+		t.Errorf("Expected nil, got %q", b)
+	}
+	lg.Write([]byte("0123456789"))
+	if b := lg.Snapshot(); string(b) != "0123456789" {
+		t.Error("Expected 0123456789, got", string(b))
+	}
+	lg.Flush()
+
+	lg.Write([]byte("abcdefgh")) // wraps around the buffer end
+	lg.Write([]byte("ijk"))
+	if b := lg.Snapshot(); string(b) != "abcdefghijk" {
+		t.Error("Expected abcdefghijk, got", string(b))
+	}
+
+	lg.Close()
+	if b := lg.Snapshot(); b != nil {
+		t.Errorf("Expected nil after Close, got %q", b)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	var tb testBuffer
+	var sampled int
+	lg := New(LogConfig{Out: &tb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, FlashPeriod: time.Hour, SamplingRate: 3, SampleAlways: true,
+		SampledHandler: func(n int) { sampled += n }})
+	defer lg.Close()
+	for i := 1; i <= 7; i++ {
+		lg.Write([]byte(strconv.Itoa(i)))
+	}
+	lg.Close()
+	if tb.buf.String() != "147" || sampled != 4 || lg.Metrics().SampledRecords != 4 {
+		t.Error("Expected output = 147 with 4 sampled out, got", tb.buf.String(), sampled, lg.Metrics().SampledRecords)
+	}
+
+	// without SampleAlways, only once the buffer is full
+	tb = testBuffer{}
+	skipped, sampled := 0, 0
+	lg = New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour, SamplingRate: 3,
+		SkipHandler:    func(n int) { skipped += n },
+		SampledHandler: func(n int) { sampled += n }})
+	defer lg.Close()
+	for i := 0; i < 7; i++ {
+		lg.Write([]byte("test"))
+	}
+	lg.Close()
+	// 3 records fit, the 4th turns on skipping, the 5th is kept by sampling but does not fit either
+	if tb.buf.String() != "testtesttest" || skipped != 2 || sampled != 2 {
+		t.Error("Expected 3 records, 2 skipped and 2 sampled out, got", tb.buf.String(), skipped, sampled)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	tb := testBuffer{panicbit: true}
+	failed := make(chan error, 1)
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 16, FlashPeriod: time.Hour, HealthWindow: 100 * time.Millisecond,
+		WriteErrorHandlerErr: func(out io.Writer, err error) {
+			select {
+			case failed <- err:
+			default:
+			}
+		}})
+	defer lg.Close()
+
+	if !lg.Healthy() {
+		t.Error("Expected a new LogWriter to be healthy")
+	}
+	lg.Write([]byte("test1"))
+	lg.Flush()
+	<-failed
+	if lg.Healthy() {
+		t.Error("Expected unhealthy after a write error")
+	}
+	testSleep(150)
+	if !lg.Healthy() {
+		t.Error("Expected healthy after HealthWindow")
+	}
+
+	// the buffer fills up
+	for i := 0; i < 4; i++ {
+		lg.Write([]byte("test2"))
+	}
+	if lg.Healthy() {
+		t.Error("Expected unhealthy while skipping")
+	}
+	lg.Close()
+	if lg.Healthy() {
+		t.Error("Expected unhealthy after Close")
+	}
+}
+
+func TestHighWaterMark(t *testing.T) {
+	var tb testBuffer
+	lg := New(LogConfig{Out: &tb, ChannelCapacity: testChannelCapacity, MaxBufSize: 64, FlashPeriod: time.Hour})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	lg.Write([]byte("test2"))
+	lg.Flush()
+	lg.Write([]byte("test3"))
+	if st := lg.Stats(); st.HighWaterMark != 10 || st.UsedBytes != 5 {
+		t.Error("Expected HighWaterMark = 10 with 5 bytes used, got", st)
+	}
+	lg.Flush()
+	if n := lg.Stats().HighWaterMark; n != 10 {
+		t.Error("Expected HighWaterMark = 10 after the buffer is empty, got", n)
+	}
+}
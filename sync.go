@@ -0,0 +1,26 @@
+package logwriter
+
+import (
+	"fmt"
+	"io"
+)
+
+// syncer is an Out that can commit the written data to stable storage, such as *os.File.
+type syncer interface {
+	Sync() error
+}
+
+// syncOut calls Sync of out, if it has one, for SyncInterval and SyncBytes.
+// A failed Sync is reported like a failed write, but does not open the circuit: the data has been written to out.
+func (l *LogWriter) syncOut(out io.Writer) {
+	s, ok := out.(syncer)
+	if !ok {
+		return
+	}
+	err := s.Sync()
+	if err == nil {
+		return
+	}
+	l.warn(fmt.Sprintf("logwriter: can not sync Out: %v", err))
+	l.writeFailed(out, err, l.clock.Now())
+}
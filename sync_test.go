@@ -0,0 +1,121 @@
+package logwriter
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a testBuffer with a Sync method, like *os.File.
+type syncBuffer struct {
+	testBuffer
+	syncs   int
+	syncErr error
+}
+
+func (b *syncBuffer) Sync() error {
+	b.syncs++
+	return b.syncErr
+}
+
+func TestSyncBytes(t *testing.T) {
+	var sb syncBuffer
+	lg := New(LogConfig{Out: &sb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, ChunkSize: 1, FlashPeriod: time.Hour, SyncBytes: 10})
+	defer lg.Close()
+
+	lg.WriteAndWait([]byte("test1"))
+	if sb.syncs != 0 {
+		t.Error("Expected no Sync before 10 bytes, got", sb.syncs)
+	}
+	lg.WriteAndWait([]byte("test2"))
+	if sb.syncs != 1 {
+		t.Error("Expected a Sync after 10 bytes, got", sb.syncs)
+	}
+	lg.WriteAndWait([]byte("test3"))
+	// the rest is synced on Close
+	lg.Close()
+	if sb.syncs != 2 {
+		t.Error("Expected a Sync on Close, got", sb.syncs)
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	var sb syncBuffer
+	sb.syncErr = errors.New("sync failed")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := &fakeClock{now: start, tick: make(chan time.Time)}
+	var syncErr, namedErr error
+	var errorCount int
+	lg := New(LogConfig{Out: &sb, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, ImmediateFlush: true, SyncInterval: time.Minute, clock: clk,
+		WriteErrorHandler:      func(out io.Writer) { errorCount++ },
+		WriteErrorHandlerErr:   func(out io.Writer, err error) { syncErr = err },
+		NamedWriteErrorHandler: func(name string, out io.Writer, err error) { namedErr = err }})
+	defer lg.Close()
+
+	lg.WriteAndWait([]byte("test1"))
+	clk.tick <- start.Add(30 * time.Second)
+	clk.tick <- start.Add(time.Minute)
+	// the ticker has been handled by the time ioHandler takes the next tick
+	clk.tick <- start.Add(time.Minute)
+	if sb.syncs != 1 {
+		t.Error("Expected a Sync after a minute, got", sb.syncs)
+	}
+	if syncErr != sb.syncErr || lg.Metrics().WriteErrors != 1 {
+		t.Error("Expected the Sync error to count as a write error, got", syncErr, lg.Metrics())
+	}
+	if errorCount != 1 || namedErr != sb.syncErr {
+		t.Error("Expected the Sync error to be reported to all write error handlers, got", errorCount, namedErr)
+	}
+	if lg.Healthy() {
+		t.Error("Expected Healthy = false after a failed Sync")
+	}
+
+	// nothing written, nothing to sync
+	lg.Close()
+	if sb.syncs != 1 {
+		t.Error("Expected no Sync on Close, got", sb.syncs)
+	}
+}
+
+// hungSyncWriter is an enteredWriter with a Sync method.
+type hungSyncWriter struct {
+	enteredWriter
+	syncs int
+}
+
+func (w *hungSyncWriter) Sync() error {
+	w.syncs++
+	return nil
+}
+
+func TestSyncIntervalWhileBusy(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := &fakeClock{now: start, tick: make(chan time.Time)}
+	hw := &hungSyncWriter{enteredWriter: enteredWriter{hungWriter{release: make(chan struct{})}, make(chan struct{}, 8)}}
+	lg := New(LogConfig{Out: hw, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity,
+		DeferFlushWhileBusy: true, SyncInterval: time.Minute, clock: clk})
+	defer lg.Close()
+
+	lg.Write([]byte("test1"))
+	flushed := make(chan error)
+	go func() { flushed <- lg.Flush() }()
+	<-hw.entered
+	// queue records while ioHandler writes test1, so the tick comes while they are waiting
+	for i := 0; i < 50; i++ {
+		lg.Write([]byte("test2"))
+	}
+	ticked := make(chan struct{})
+	go func() {
+		clk.tick <- start.Add(time.Minute)
+		close(ticked)
+	}()
+	close(hw.release)
+	<-flushed
+	<-ticked
+
+	lg.Flush()
+	if hw.syncs != 1 {
+		t.Error("Expected a Sync of test1 while records were queued, got", hw.syncs)
+	}
+}
@@ -0,0 +1,56 @@
+package logwriter
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const tailChanSize = 64
+
+// Tail returns a channel that receives a copy of each record as it is buffered, and a cancel function.
+// It is intended for "live tail" viewers and does not affect writing to Out.
+// Records are sent without blocking: if the receiver does not keep up, records are dropped for it.
+// The cancel function unsubscribes and closes the channel; it may be called more than once.
+// Multiple tailers may be active at the same time.
+func (l *LogWriter) Tail() (<-chan []byte, func()) {
+	ch := make(chan []byte, tailChanSize)
+
+	l.muTail.Lock()
+	l.tailers = append(l.tailers, ch)
+	atomic.StoreInt32(&l.numTailers, int32(len(l.tailers)))
+	l.muTail.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			l.muTail.Lock()
+			defer l.muTail.Unlock()
+			for i, c := range l.tailers {
+				if c == ch {
+					l.tailers = append(l.tailers[:i], l.tailers[i+1:]...)
+					break
+				}
+			}
+			atomic.StoreInt32(&l.numTailers, int32(len(l.tailers)))
+			close(ch)
+		})
+	}
+
+	return ch, cancel
+}
+
+func (l *LogWriter) tail(rec record) {
+	l.muTail.Lock()
+	defer l.muTail.Unlock()
+
+	for _, ch := range l.tailers {
+		r := make([]byte, 0, rec.len())
+		for _, b := range rec {
+			r = append(r, b...)
+		}
+		select {
+		case ch <- r:
+		default:
+		}
+	}
+}
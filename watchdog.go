@@ -0,0 +1,39 @@
+package logwriter
+
+import "time"
+
+// watchdog calls StallHandler when records are waiting but nothing has been written to Out for StallTimeout.
+// It runs in a goroutine of its own, so it notices a write to Out that never returns, and stops with ioHandler.
+func (l *LogWriter) watchdog() {
+	ticker := l.clock.NewTicker(l.stallTimeout / 2)
+	defer ticker.Stop()
+
+	// stalled is set once StallHandler has been called for the current stall
+	var stalled bool
+	for {
+		var now time.Time
+		select {
+		case <-l.done:
+			return
+		case now = <-ticker.C():
+		}
+
+		l.muInternal.Lock()
+		waiting := l.startPos != l.endPos || l.queuedLen() > 0
+		l.muInternal.Unlock()
+		if !waiting {
+			// nothing to write is not a stall: the timeout starts with the next record
+			l.progress.Store(now.UnixNano())
+			stalled = false
+			continue
+		}
+
+		since := now.Sub(time.Unix(0, l.progress.Load()))
+		if since < l.stallTimeout {
+			stalled = false
+		} else if !stalled {
+			stalled = true
+			l.stallHandler(since)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package logwriter
+
+import (
+	"testing"
+	"time"
+)
+
+// enteredWriter is a hungWriter that tells when a write has started.
+type enteredWriter struct {
+	hungWriter
+	entered chan struct{}
+}
+
+func (w *enteredWriter) Write(p []byte) (int, error) {
+	w.entered <- struct{}{}
+	return w.hungWriter.Write(p)
+}
+
+func TestStallHandler(t *testing.T) {
+	hw := &enteredWriter{hungWriter{release: make(chan struct{})}, make(chan struct{}, 1)}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// with ImmediateFlush the ticker of the watchdog is the only one
+	clk := &fakeClock{now: start, tick: make(chan time.Time)}
+	stalls := make(chan time.Duration, 2)
+	lg := New(LogConfig{Out: hw, MaxBufSize: testBufSize, ChannelCapacity: testChannelCapacity, ImmediateFlush: true, StallTimeout: time.Minute, clock: clk,
+		StallHandler: func(d time.Duration) { stalls <- d }})
+	defer lg.Close()
+
+	// idle time is not a stall
+	clk.set(start.Add(time.Hour))
+	clk.tick <- clk.Now()
+	clk.tick <- clk.Now()
+	lg.Write([]byte("test1"))
+	<-hw.entered
+	clk.set(clk.Now().Add(30 * time.Second))
+	clk.tick <- clk.Now()
+	clk.set(clk.Now().Add(time.Minute))
+	clk.tick <- clk.Now()
+	clk.tick <- clk.Now()
+	// the watchdog has run its checks by the time it takes the next tick
+	clk.tick <- clk.Now()
+
+	if len(stalls) != 1 {
+		t.Fatal("Expected one stall, got", len(stalls))
+	}
+	if d := <-stalls; d != 90*time.Second {
+		t.Error("Expected a stall of 90s, got", d)
+	}
+
+	close(hw.release)
+	lg.Close()
+	if hw.buf.String() != "test1" {
+		t.Error("Expected output = test1, got", hw.buf.String())
+	}
+}
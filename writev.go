@@ -0,0 +1,48 @@
+package logwriter
+
+import (
+	"io"
+	"net"
+)
+
+// WritevWriter is implemented by an Out that writes several buffers with one call, like writev(2).
+// LogWriter uses it, or the writev of *net.TCPConn and *net.UnixConn, to write a record wrapped around the end of the buffer
+// in one write instead of two, without joining its parts into a copy. Writev returns the number of bytes written
+// from all the buffers and a non-nil error if it is less than their total length.
+type WritevWriter interface {
+	Writev(bufs [][]byte) (n int64, err error)
+}
+
+// vectored reports whether out writes several buffers with one call.
+func vectored(out io.Writer) bool {
+	switch out.(type) {
+	case WritevWriter, *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// writev writes p and q to a vectored out and returns the number of bytes written.
+func writev(p, q []byte, out io.Writer) (n int, err error) {
+	bufs := net.Buffers{p, q}
+	var c int64
+	if w, ok := out.(WritevWriter); ok {
+		c, err = w.Writev(bufs)
+	} else {
+		// net.Buffers uses writev for network connections and repeats short writes
+		c, err = bufs.WriteTo(out)
+	}
+	n = int(c)
+	if err == nil && n < len(p)+len(q) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// rest returns what is left of p and q after their first n bytes are written.
+func rest(p, q []byte, n int) ([]byte, []byte) {
+	if n < len(p) {
+		return p[n:], q
+	}
+	return nil, q[n-len(p):]
+}
@@ -0,0 +1,98 @@
+package logwriter
+
+import (
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// vectorBuffer is a testBuffer that implements WritevWriter. Writev calls are kept in vectors, not in calls and chunks.
+type vectorBuffer struct {
+	testBuffer
+	vectors [][]string
+}
+
+func (vb *vectorBuffer) Writev(bufs [][]byte) (int64, error) {
+	var v []string
+	var n int64
+	for _, b := range bufs {
+		v = append(v, string(b))
+		c, _ := vb.buf.Write(b)
+		n += int64(c)
+	}
+	vb.vectors = append(vb.vectors, v)
+	return n, nil
+}
+
+func TestWritev(t *testing.T) {
+	for _, config := range []LogConfig{{ImmediateFlush: true}, {AtomicRecords: true}, {FlashPeriod: time.Hour}} {
+		var vb vectorBuffer
+		config.Out = &vb
+		config.MaxBufSize = 16
+		lg := New(config)
+
+		lg.WriteAndWait([]byte("test1test1"))
+		// the record wraps around the end of the buffer
+		lg.WriteAndWait([]byte("0123456789"))
+
+		if vb.buf.String() != "test1test10123456789" {
+			t.Error("Expected output = test1test10123456789, got", vb.buf.String())
+		}
+		if len(vb.vectors) != 1 || !slices.Equal(vb.vectors[0], []string{"012345", "6789"}) {
+			t.Error("Expected one vectored write of the wrapped record, got", vb.vectors)
+		}
+		if vb.calls != 1 {
+			t.Error("Expected one plain write, got", vb.chunks)
+		}
+	}
+}
+
+func benchmarkWrapped(b *testing.B, out io.Writer) {
+	lg := New(LogConfig{Out: out, ChannelCapacity: testChannelCapacity, MaxBufSize: 1000, ImmediateFlush: true})
+	defer lg.Close()
+	// most records wrap around the end of the buffer
+	line := make([]byte, 333)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lg.WriteAndWait(line)
+	}
+	b.StopTimer()
+	lg.Close()
+}
+
+func BenchmarkWrappedPlain(b *testing.B) {
+	var tb testBuffer
+	benchmarkWrapped(b, &tb)
+	b.ReportMetric(float64(tb.calls)/float64(b.N), "writes/op")
+}
+
+func BenchmarkWrappedWritev(b *testing.B) {
+	var vb vectorBuffer
+	benchmarkWrapped(b, &vb)
+	b.ReportMetric(float64(vb.calls+len(vb.vectors))/float64(b.N), "writes/op")
+}
+
+// BenchmarkWrappedTCP writes to a loopback connection, where a wrapped record costs one writev instead of two writes.
+func BenchmarkWrappedTCP(b *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skip(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			io.Copy(io.Discard, c)
+			c.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	benchmarkWrapped(b, conn)
+}